@@ -24,6 +24,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
+  const visibility = document.getElementById('video-visibility').value;
 
   try {
     const res = await fetch('/api/videos', {
@@ -32,7 +33,7 @@ async function createVideoDraft() {
         'Content-Type': 'application/json',
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
@@ -152,30 +153,50 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// Browsers leave the type of some video files, like MKV, empty.
+const VIDEO_TYPES_BY_EXTENSION = {
+  mp4: 'video/mp4',
+  mov: 'video/quicktime',
+  webm: 'video/webm',
+  mkv: 'video/x-matroska',
+  avi: 'video/x-msvideo',
+};
+
+function videoFileType(videoFile) {
+  if (videoFile.type) return videoFile.type;
+  const extension = videoFile.name.split('.').pop().toLowerCase();
+  return VIDEO_TYPES_BY_EXTENSION[extension] || 'application/octet-stream';
+}
+
+// Files bigger than this are sent with tus so a dropped connection or a
+// reload only costs the chunk in flight.
+const RESUMABLE_UPLOAD_THRESHOLD = 50 * 1024 * 1024;
+
 async function uploadVideoFile(videoID) {
   const videoFile = document.getElementById('video-file').files[0];
   if (!videoFile) return;
 
-  const formData = new FormData();
-  formData.append('video', videoFile);
-
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
-      method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-      body: formData,
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+    // Big files go through tus whatever the storage backend, so they can
+    // be resumed. Smaller ones go straight to the bucket when it can take
+    // them, and through the server otherwise.
+    let jobID = null;
+    if (videoFile.size <= RESUMABLE_UPLOAD_THRESHOLD) {
+      jobID = await uploadVideoDirect(videoID, videoFile);
+    }
+    if (jobID === null && videoFile.size > RESUMABLE_UPLOAD_THRESHOLD) {
+      jobID = await uploadVideoResumable(videoID, videoFile, uploadBtnSelector);
+    } else if (jobID === null) {
+      jobID = await uploadVideoMultipart(videoID, videoFile);
     }
 
-    console.log('Video uploaded!');
+    console.log('Video uploaded, processing...');
+    document.getElementById(uploadBtnSelector).textContent = 'Processing...';
+    await waitForJob(jobID);
+    console.log('Video processed!');
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -184,11 +205,151 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// uploadVideoDirect posts the file straight to the bucket. It returns null
+// when the server's storage doesn't support that, or the file is too big to
+// send in one request.
+async function uploadVideoDirect(videoID, videoFile) {
+  const headers = {
+    Authorization: `Bearer ${localStorage.getItem('token')}`,
+    'Content-Type': 'application/json',
+  };
+
+  const presignRes = await fetch(`/api/video_upload/${videoID}/presign`, {
+    method: 'POST',
+    headers,
+    body: JSON.stringify({ content_type: videoFileType(videoFile), size: videoFile.size }),
+  });
+  if (presignRes.status === 501 || presignRes.status === 413) {
+    return null;
+  }
+  const presigned = await presignRes.json();
+  if (!presignRes.ok) {
+    throw new Error(`Failed to start upload. Error: ${presigned.error}`);
+  }
+
+  const formData = new FormData();
+  for (const [name, value] of Object.entries(presigned.fields)) {
+    formData.append(name, value);
+  }
+  formData.append('file', videoFile);
+  const uploadRes = await fetch(presigned.url, { method: 'POST', body: formData });
+  if (!uploadRes.ok) {
+    throw new Error(`Failed to upload video file to storage. Status: ${uploadRes.status}`);
+  }
+
+  const completeRes = await fetch(`/api/video_upload/${videoID}/complete`, {
+    method: 'POST',
+    headers,
+    body: JSON.stringify({ key: presigned.key }),
+  });
+  const job = await completeRes.json();
+  if (!completeRes.ok) {
+    throw new Error(`Failed to finish upload. Error: ${job.error}`);
+  }
+  return job.id;
+}
+
+async function uploadVideoMultipart(videoID, videoFile) {
+  const formData = new FormData();
+  const typedFile = new File([videoFile], videoFile.name, { type: videoFileType(videoFile) });
+  formData.append('video', typedFile);
+
+  const res = await fetch(`/api/video_upload/${videoID}`, {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: formData,
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to upload video file. Error: ${data.error}`);
+  }
+  return data.id;
+}
+
+function uploadVideoResumable(videoID, videoFile, buttonID) {
+  return new Promise((resolve, reject) => {
+    let jobID = null;
+    const upload = new tus.Upload(videoFile, {
+      endpoint: '/api/uploads',
+      chunkSize: 16 * 1024 * 1024,
+      retryDelays: [0, 1000, 3000, 5000, 10000],
+      removeFingerprintOnSuccess: true,
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+      metadata: {
+        video_id: videoID,
+        filename: videoFile.name,
+        filetype: videoFileType(videoFile),
+      },
+      onProgress: (sent, total) => {
+        const percent = Math.floor((sent / total) * 100);
+        document.getElementById(buttonID).textContent = `Uploading ${percent}%`;
+      },
+      onAfterResponse: (req, res) => {
+        const id = res.getHeader('Tubely-Job-ID');
+        if (id) jobID = id;
+      },
+      onError: (error) => reject(new Error(`Failed to upload video file. Error: ${error.message}`)),
+      onSuccess: () => resolve(jobID),
+    });
+
+    // Pick up where an earlier attempt at the same file left off.
+    upload.findPreviousUploads().then((previousUploads) => {
+      if (previousUploads.length > 0) {
+        upload.resumeFromPreviousUpload(previousUploads[0]);
+      }
+      upload.start();
+    });
+  });
+}
+
+async function waitForJob(jobID) {
+  while (true) {
+    const res = await fetch(`/api/jobs/${jobID}`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const job = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to get processing status. Error: ${job.error}`);
+    }
+    if (job.status === 'succeeded') {
+      return job;
+    }
+    if (job.status === 'failed') {
+      throw new Error(`Failed to process video. Error: ${job.last_error}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
-async function getVideos() {
+let nextVideosCursor = null;
+let videoSearchQuery = '';
+
+document.getElementById('video-search-form').addEventListener('submit', async (event) => {
+  event.preventDefault();
+  videoSearchQuery = document.getElementById('video-search').value.trim();
+  await getVideos();
+});
+
+async function getVideos(cursor = null) {
   try {
-    const res = await fetch('/api/videos', {
+    const params = new URLSearchParams({ limit: '25' });
+    if (cursor) {
+      params.set('cursor', cursor);
+    }
+    let url = `/api/videos?${params}`;
+    if (videoSearchQuery) {
+      params.set('q', videoSearchQuery);
+      url = `/api/videos/search?${params}`;
+    }
+    const res = await fetch(url, {
       method: 'GET',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -199,20 +360,32 @@ async function getVideos() {
       throw new Error(`Failed to get videos. Error: ${data.error}`);
     }
 
-    const videos = await res.json();
+    const data = await res.json();
+    const videos = videoSearchQuery ? data.results.map((result) => result.video) : data.videos;
     const videoList = document.getElementById('video-list');
-    videoList.innerHTML = '';
+    if (!cursor) {
+      videoList.innerHTML = '';
+    }
     for (const video of videos) {
       const listItem = document.createElement('li');
       listItem.textContent = video.title;
       listItem.onclick = () => videoStateHandler(video.id);
       videoList.appendChild(listItem);
     }
+
+    nextVideosCursor = data.next_cursor;
+    document.getElementById('load-more-videos-btn').style.display = data.next_cursor ? 'block' : 'none';
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 }
 
+async function loadMoreVideos() {
+  if (nextVideosCursor) {
+    await getVideos(nextVideosCursor);
+  }
+}
+
 function createVideoStateHandler() {
   let currentVideoID = null;
 
@@ -242,6 +415,7 @@ async function getVideo(videoID) {
     }
 
     const video = await res.json();
+    currentVideoETag = res.headers.get('ETag');
     viewVideo(video);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -249,12 +423,16 @@ async function getVideo(videoID) {
 }
 
 let currentVideo = null;
+let currentVideoETag = null;
 
 function viewVideo(video) {
   currentVideo = video;
   document.getElementById('video-display').style.display = 'block';
   document.getElementById('video-title-display').textContent = video.title;
   document.getElementById('video-description-display').textContent = video.description;
+  document.getElementById('edit-video-title').value = video.title;
+  document.getElementById('edit-video-description').value = video.description;
+  document.getElementById('edit-video-visibility').value = video.visibility;
 
   const thumbnailImg = document.getElementById('thumbnail-image');
   if (!video.thumbnail_url) {
@@ -266,13 +444,77 @@ function viewVideo(video) {
 
   const videoPlayer = document.getElementById('video-player');
   if (videoPlayer) {
-    if (!video.video_url) {
+    if (hlsPlayer) {
+      hlsPlayer.destroy();
+      hlsPlayer = null;
+    }
+    if (!video.video_url && !video.hls_url) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
+      loadVideoSource(videoPlayer, video);
+    }
+  }
+}
+
+let hlsPlayer = null;
+
+// Prefer the adaptive HLS stream and fall back to the MP4 when the browser
+// can't play HLS or the renditions aren't ready yet.
+function loadVideoSource(videoPlayer, video) {
+  if (video.hls_url) {
+    if (videoPlayer.canPlayType('application/vnd.apple.mpegurl')) {
+      videoPlayer.src = video.hls_url;
       videoPlayer.load();
+      return;
+    }
+    if (window.Hls && Hls.isSupported()) {
+      videoPlayer.removeAttribute('src');
+      hlsPlayer = new Hls();
+      hlsPlayer.loadSource(video.hls_url);
+      hlsPlayer.attachMedia(videoPlayer);
+      return;
+    }
+  }
+  videoPlayer.src = video.video_url;
+  videoPlayer.load();
+}
+
+async function updateVideoDetails() {
+  if (!currentVideo) return;
+
+  const title = document.getElementById('edit-video-title').value;
+  const description = document.getElementById('edit-video-description').value;
+  const visibility = document.getElementById('edit-video-visibility').value;
+  const headers = {
+    'Content-Type': 'application/json',
+    Authorization: `Bearer ${localStorage.getItem('token')}`,
+  };
+  if (currentVideoETag) {
+    headers['If-Match'] = currentVideoETag;
+  }
+
+  try {
+    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+      method: 'PATCH',
+      headers,
+      body: JSON.stringify({ title, description, visibility }),
+    });
+    const data = await res.json();
+    if (res.status === 412 || res.status === 428) {
+      alert('This video was changed somewhere else. Reloading the latest version.');
+      await getVideo(currentVideo.id);
+      return;
     }
+    if (!res.ok) {
+      throw new Error(`Failed to update video. Error: ${data.error}`);
+    }
+
+    currentVideoETag = res.headers.get('ETag');
+    viewVideo(data);
+    await getVideos();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
   }
 }
 
@@ -1,12 +1,25 @@
 package main
 
 import (
-	"os"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
 )
 
-func (cfg apiConfig) ensureAssetsDir() error {
-	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
-		return os.Mkdir(cfg.assetsRoot, 0755)
+// randomName returns a URL safe, unguessable name for a stored object.
+func randomName() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+func mediaTypeToExt(mediaType string) string {
+	parts := strings.Split(mediaType, "/")
+	if len(parts) != 2 {
+		return ".bin"
+	}
+	return "." + parts[1]
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// cdnDelivery is how videos of one visibility are handed out through
+// CloudFront.
+type cdnDelivery string
+
+const (
+	// cdnPlain links straight to the distribution. Only for content the
+	// distribution serves to anyone.
+	cdnPlain cdnDelivery = "plain"
+	// cdnSignedURL signs every link with its own policy.
+	cdnSignedURL cdnDelivery = "signed-url"
+	// cdnSignedCookie gives out plain links and sets CloudFront cookies that
+	// cover all of the video's files when it's fetched.
+	cdnSignedCookie cdnDelivery = "signed-cookie"
+)
+
+var defaultCDNDelivery = map[database.Visibility]cdnDelivery{
+	database.VisibilityPublic:   cdnPlain,
+	database.VisibilityUnlisted: cdnSignedURL,
+	database.VisibilityPrivate:  cdnSignedURL,
+}
+
+// cloudFrontConfig is set when videos are served through CloudFront with a
+// signing key. Without it, video links are presigned S3 URLs.
+type cloudFrontConfig struct {
+	signer       *cloudfront.Signer
+	delivery     map[database.Visibility]cdnDelivery
+	bindClientIP bool
+	cookieDomain string
+}
+
+// loadCloudFrontConfig returns nil unless CF_KEY_PAIR_ID is set. Cookies
+// must be for a domain both the API at apiHost and the distribution belong
+// to, or browsers won't store or send them.
+func loadCloudFrontConfig(apiHost, distribution string) (*cloudFrontConfig, error) {
+	keyPairID := os.Getenv("CF_KEY_PAIR_ID")
+	if keyPairID == "" {
+		return nil, nil
+	}
+
+	keyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+	if keyPath == "" {
+		return nil, errors.New("CF_PRIVATE_KEY_PATH must be set along with CF_KEY_PAIR_ID")
+	}
+	pemBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CloudFront private key: %w", err)
+	}
+	key, err := cloudfront.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load CloudFront private key: %w", err)
+	}
+
+	delivery, err := parseCDNDelivery(os.Getenv("CF_DELIVERY"))
+	if err != nil {
+		return nil, err
+	}
+
+	cookieDomain := os.Getenv("CF_COOKIE_DOMAIN")
+	if slices.Contains(slices.Collect(maps.Values(delivery)), cdnSignedCookie) {
+		if cookieDomain == "" {
+			return nil, errors.New("CF_COOKIE_DOMAIN must be set when CF_DELIVERY uses signed-cookie")
+		}
+		for _, host := range []string{apiHost, distribution} {
+			if !inCookieDomain(host, cookieDomain) {
+				return nil, fmt.Errorf("CF_COOKIE_DOMAIN %q doesn't cover %q", cookieDomain, host)
+			}
+		}
+	}
+
+	return &cloudFrontConfig{
+		signer:       cloudfront.NewSigner(keyPairID, key),
+		delivery:     delivery,
+		bindClientIP: os.Getenv("CF_BIND_CLIENT_IP") == "true",
+		cookieDomain: cookieDomain,
+	}, nil
+}
+
+// inCookieDomain reports whether a cookie for domain is sent to host.
+func inCookieDomain(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// parseCDNDelivery reads a list like "public=plain,private=signed-cookie".
+// Visibilities that aren't listed keep their default.
+func parseCDNDelivery(raw string) (map[database.Visibility]cdnDelivery, error) {
+	delivery := map[database.Visibility]cdnDelivery{}
+	for visibility, mode := range defaultCDNDelivery {
+		delivery[visibility] = mode
+	}
+
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return delivery, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		visibilityStr, modeStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		visibility := database.Visibility(visibilityStr)
+		if !ok || !visibility.Valid() {
+			return nil, fmt.Errorf("invalid CloudFront delivery %q, expected <visibility>=<mode>", part)
+		}
+		mode := cdnDelivery(modeStr)
+		switch mode {
+		case cdnPlain, cdnSignedURL, cdnSignedCookie:
+		default:
+			return nil, fmt.Errorf("invalid CloudFront delivery mode %q, expected plain, signed-url or signed-cookie", modeStr)
+		}
+		delivery[visibility] = mode
+	}
+	return delivery, nil
+}
+
+// cloudFrontPolicy grants access to resource for as long as our other media
+// links last, from the caller's address only if so configured.
+func (cfg *apiConfig) cloudFrontPolicy(r *http.Request, resource string) cloudfront.Policy {
+	policy := cloudfront.Policy{
+		Resource: resource,
+		Expires:  time.Now().Add(cfg.mediaURLExpiry),
+	}
+	if cfg.cloudFront.bindClientIP {
+		policy.IPRange = clientIPRange(r)
+	}
+	return policy
+}
+
+func clientIPRange(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// cloudFrontCookiesKey marks a request whose response carries CloudFront
+// cookies. Its value is the ID of the video they cover.
+type cloudFrontCookiesKey struct{}
+
+// cdnDelivery is how the video's files are handed out in response to r.
+// Cookies cover a single video and are only set when it's fetched on its
+// own, so lists and search results get signed links instead.
+func (cfg *apiConfig) cdnDelivery(r *http.Request, video database.Video) cdnDelivery {
+	delivery := cfg.cloudFront.delivery[video.Visibility]
+	if delivery == cdnSignedCookie && r.Context().Value(cloudFrontCookiesKey{}) != video.ID {
+		return cdnSignedURL
+	}
+	return delivery
+}
+
+// cloudFrontURL links to a file of the video through the distribution, the
+// way the video's visibility calls for.
+func (cfg *apiConfig) cloudFrontURL(r *http.Request, video database.Video, key string) *string {
+	fileURL := cfg.videoStore.URL(key)
+	if cfg.cdnDelivery(r, video) != cdnSignedURL {
+		return &fileURL
+	}
+
+	// Segments are fetched relative to the playlist and wouldn't carry its
+	// signature, so signed playlists go through handlerPlaylist.
+	if path.Ext(key) == ".m3u8" {
+		signed := cfg.signURL(cfg.playlistURL(key))
+		return &signed
+	}
+	signed, err := cfg.cloudFront.signer.SignURL(fileURL, cfg.cloudFrontPolicy(r, ""))
+	if err != nil {
+		log.Printf("Couldn't sign CloudFront URL for %s: %v", key, err)
+		return nil
+	}
+	return &signed
+}
+
+// setCloudFrontCookies sets signed cookies covering every file of the video
+// if its visibility is delivered that way. Links made for the returned
+// request rely on them.
+func (cfg *apiConfig) setCloudFrontCookies(w http.ResponseWriter, r *http.Request, video database.Video) (*http.Request, error) {
+	if cfg.cloudFront == nil || cfg.cloudFront.delivery[video.Visibility] != cdnSignedCookie || video.VideoKey == nil {
+		return r, nil
+	}
+
+	// The MP4 and the HLS stream share this prefix; see hlsPrefix.
+	prefix := strings.TrimSuffix(*video.VideoKey, path.Ext(*video.VideoKey))
+	policy := cfg.cloudFrontPolicy(r, cfg.videoStore.URL(prefix)+"*")
+	cookies, err := cfg.cloudFront.signer.Cookies(policy)
+	if err != nil {
+		return nil, err
+	}
+	for _, cookie := range cookies {
+		cookie.Domain = cfg.cloudFront.cookieDomain
+		cookie.Path = "/"
+		cookie.Expires = policy.Expires
+		cookie.Secure = true
+		cookie.HttpOnly = true
+		http.SetCookie(w, cookie)
+	}
+	return r.WithContext(context.WithValue(r.Context(), cloudFrontCookiesKey{}, video.ID)), nil
+}
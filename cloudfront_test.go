@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func newTestCloudFrontKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestLoadCloudFrontConfigCookieDomain(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "cloudfront.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(newTestCloudFrontKey(t))})
+	err := os.WriteFile(keyPath, pemBytes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CF_KEY_PAIR_ID", "K2JCJMDEHXQW5F")
+	t.Setenv("CF_PRIVATE_KEY_PATH", keyPath)
+
+	tests := []struct {
+		delivery string
+		domain   string
+		wantErr  bool
+	}{
+		{delivery: "", domain: "", wantErr: false},
+		{delivery: "private=signed-cookie", domain: "", wantErr: true},
+		{delivery: "private=signed-cookie", domain: "example.com", wantErr: false},
+		{delivery: "private=signed-cookie", domain: ".example.com", wantErr: false},
+		{delivery: "private=signed-cookie", domain: "media.example.com", wantErr: true},
+		{delivery: "private=signed-cookie", domain: "other.com", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Setenv("CF_DELIVERY", tc.delivery)
+		t.Setenv("CF_COOKIE_DOMAIN", tc.domain)
+		cfg, err := loadCloudFrontConfig("api.example.com", "media.example.com")
+		if (err != nil) != tc.wantErr {
+			t.Errorf("delivery %q, domain %q: got error %v, want error %v", tc.delivery, tc.domain, err, tc.wantErr)
+			continue
+		}
+		if err == nil && cfg.cookieDomain != tc.domain {
+			t.Errorf("got cookie domain %q, want %q", cfg.cookieDomain, tc.domain)
+		}
+	}
+}
+
+func TestCookieDeliveryOnlyForSingleVideo(t *testing.T) {
+	ut, _ := newS3UploadTest(t)
+	ut.mux.HandleFunc("GET /api/videos/search", ut.cfg.handlerVideosSearch)
+	ut.cfg.cloudFront = &cloudFrontConfig{
+		signer: cloudfront.NewSigner("K2JCJMDEHXQW5F", newTestCloudFrontKey(t)),
+		delivery: map[database.Visibility]cdnDelivery{
+			database.VisibilityPublic:   cdnSignedCookie,
+			database.VisibilityUnlisted: cdnSignedCookie,
+			database.VisibilityPrivate:  cdnSignedCookie,
+		},
+		cookieDomain: "example.com",
+	}
+	ut.uploadJob(t)
+	ut.runJobs(t)
+
+	rec := ut.get(t, "/api/videos/"+ut.videoID.String())
+	var video database.Video
+	err := json.NewDecoder(rec.Body).Decode(&video)
+	if err != nil {
+		t.Fatalf("decoding video: %v", err)
+	}
+	if len(rec.Result().Cookies()) == 0 {
+		t.Error("got no CloudFront cookies")
+	}
+	if video.VideoURL == nil || strings.Contains(*video.VideoURL, "?") {
+		t.Errorf("got video URL %v, want a plain one the cookies cover", video.VideoURL)
+	}
+
+	// A list can't carry cookies for every video in it.
+	rec = ut.get(t, "/api/videos")
+	var page struct {
+		Videos []database.Video `json:"videos"`
+	}
+	err = json.NewDecoder(rec.Body).Decode(&page)
+	if err != nil {
+		t.Fatalf("decoding videos: %v", err)
+	}
+	if len(page.Videos) != 1 || page.Videos[0].VideoURL == nil || !strings.Contains(*page.Videos[0].VideoURL, "Signature=") {
+		t.Errorf("got videos %+v, want one with a signed URL", page.Videos)
+	}
+
+	rec = ut.get(t, "/api/videos/search?q=boots")
+	var results struct {
+		Results []database.VideoSearchResult `json:"results"`
+	}
+	err = json.NewDecoder(rec.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("decoding results: %v", err)
+	}
+	if len(results.Results) != 1 || results.Results[0].Video.VideoURL == nil || !strings.Contains(*results.Results[0].Video.VideoURL, "Signature=") {
+		t.Errorf("got results %+v, want one with a signed URL", results.Results)
+	}
+}
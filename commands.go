@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const usage = `usage:
+  tubely                      run the server
+  tubely migrate status       list migrations and whether they're applied
+  tubely migrate up           apply all pending migrations
+  tubely migrate down [n]     roll back the last n migrations (default 1)
+  tubely gc [flags]           report orphaned and missing files in storage;
+                              -delete removes orphans older than -grace (24h),
+                              -dry-run only lists them, -json prints JSON
+  tubely move-thumbnails      move thumbnails saved under ASSETS_ROOT to the
+                              storage backend; -dry-run only lists them`
+
+// runCommand handles the maintenance subcommands. The server itself runs
+// when no arguments are given.
+func runCommand(pathToDB string, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(pathToDB, args[1:])
+	case "gc":
+		return runGCCommand(pathToDB, args[1:])
+	case "move-thumbnails":
+		return runMoveThumbnailsCommand(pathToDB, args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+var errMemoryBackend = errors.New("the memory backend only lives inside the server")
+
+// commandConfig sets up the database and storage the way the server does,
+// from the same environment, for commands that work on the server's files.
+func commandConfig(pathToDB string) (*apiConfig, error) {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "s3"
+	}
+	if backend == "memory" {
+		return nil, errMemoryBackend
+	}
+	cfg := &apiConfig{
+		assetsRoot: os.Getenv("ASSETS_ROOT"),
+		port:       os.Getenv("PORT"),
+	}
+	if cfg.assetsRoot == "" || cfg.port == "" {
+		return nil, errors.New("ASSETS_ROOT and PORT must be set as they are for the server")
+	}
+	db, err := database.NewClient(pathToDB)
+	if err != nil {
+		return nil, err
+	}
+	cfg.db = db
+	err = cfg.setupStorage(backend)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func runMigrateCommand(pathToDB string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	db, err := database.Open(pathToDB)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return tw.Flush()
+	case "up":
+		return db.Migrate()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		return db.MigrateDown(steps)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], usage)
+	}
+}
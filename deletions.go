@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Files are removed from storage in the background. Whatever should go is
+// recorded as a pending deletion first, and stays recorded until the store
+// confirms it's gone, so a failure only delays the cleanup.
+
+const (
+	deletionStoreVideo = "video"
+	deletionStoreAsset = "asset"
+
+	deletionBatchSize = 100
+	// deletionPollInterval is how often failed deletions are looked at
+	// again. New ones are started right away.
+	deletionPollInterval = time.Minute
+)
+
+func (cfg *apiConfig) deletionStore(name string) (storage.BlobStore, error) {
+	switch name {
+	case deletionStoreVideo:
+		return cfg.videoStore, nil
+	case deletionStoreAsset:
+		return cfg.assetStore, nil
+	}
+	return nil, fmt.Errorf("unknown store %q", name)
+}
+
+// videoFiles lists what's stored for the video alone: unprocessed uploads
+// and its thumbnail. The published MP4 and renditions may be shared, and go
+// with the video's blob (see blobFiles).
+func (cfg *apiConfig) videoFiles(video database.Video) []database.CreatePendingDeletionParams {
+	files := []database.CreatePendingDeletionParams{
+		{Store: deletionStoreVideo, Key: originalsPrefix(video.ID)},
+	}
+	if video.ThumbnailKey != nil {
+		files = append(files, database.CreatePendingDeletionParams{Store: deletionStoreVideo, Key: *video.ThumbnailKey})
+	}
+	if key, ok := cfg.legacyThumbnailKey(video); ok {
+		files = append(files, database.CreatePendingDeletionParams{Store: deletionStoreAsset, Key: key})
+	}
+	return files
+}
+
+// blobFiles lists a published MP4 and its HLS renditions, which are deleted
+// once no video uses them.
+func blobFiles(key string) []database.CreatePendingDeletionParams {
+	return []database.CreatePendingDeletionParams{
+		{Store: deletionStoreVideo, Key: key},
+		{Store: deletionStoreVideo, Key: hlsPrefix(key) + "/"},
+	}
+}
+
+// scheduleDeletions records files for deletion and starts on them.
+func (cfg *apiConfig) scheduleDeletions(files ...database.CreatePendingDeletionParams) error {
+	err := cfg.db.CreatePendingDeletions(files)
+	if err != nil {
+		return err
+	}
+	cfg.wakeDeleter()
+	return nil
+}
+
+// wakeDeleter starts on newly recorded deletions without waiting for the
+// next poll.
+func (cfg *apiConfig) wakeDeleter() {
+	select {
+	case cfg.deletionsWake <- struct{}{}:
+	default:
+	}
+}
+
+// runDeletions works through pending deletions until ctx is done.
+func (cfg *apiConfig) runDeletions(ctx context.Context) {
+	ticker := time.NewTicker(deletionPollInterval)
+	defer ticker.Stop()
+	for {
+		cfg.processPendingDeletions(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cfg.deletionsWake:
+		}
+	}
+}
+
+func (cfg *apiConfig) processPendingDeletions(ctx context.Context) {
+	for ctx.Err() == nil {
+		deletions, err := cfg.db.DuePendingDeletions(time.Now(), deletionBatchSize)
+		if err != nil {
+			log.Printf("Couldn't list pending deletions: %v", err)
+			return
+		}
+
+		for _, deletion := range deletions {
+			err := cfg.deleteStoredFile(ctx, deletion.Store, deletion.Key)
+			if err != nil {
+				runAt := time.Now().Add(jobBackoff(deletion.Attempts + 1))
+				log.Printf("Couldn't delete %s from %s store, retrying at %s: %v", deletion.Key, deletion.Store, runAt.Format(time.RFC3339), err)
+				err = cfg.db.RetryPendingDeletion(deletion.ID, runAt, err.Error())
+			} else {
+				err = cfg.db.CompletePendingDeletion(deletion.ID)
+			}
+			if err != nil {
+				// The same deletions would come straight back; leave them
+				// for the next poll.
+				log.Printf("Couldn't record result of deleting %s: %v", deletion.Key, err)
+				return
+			}
+		}
+		if len(deletions) < deletionBatchSize {
+			return
+		}
+	}
+}
+
+// deleteStoredFile deletes a file, or everything under a prefix ending in
+// "/". Files that are already gone count as deleted.
+func (cfg *apiConfig) deleteStoredFile(ctx context.Context, storeName, key string) error {
+	store, err := cfg.deletionStore(storeName)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(key, "/") {
+		err = store.Delete(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	objects, err := store.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, obj := range objects {
+		err := store.Delete(ctx, obj.Key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// fakeMediaDuration is how long the fake says every video is.
+const fakeMediaDuration = 10.0
+
+// fakeMedia stands in for ffmpeg when it isn't installed, and in tests. It
+// doesn't decode anything: by default every file its signature says is a
+// video is a ten second 1080p H.264/AAC one, normalizing copies the file,
+// renditions are a playlist and a placeholder segment, and frames are a
+// gray JPEG. Setting a func scripts that step instead.
+type fakeMedia struct {
+	probe        func(filePath string) (ffprobeOutput, error)
+	normalize    func(filePath string, input ffprobeOutput) (string, error)
+	transcodeHLS func(filePath, outputDir string, rendition hlsRendition) error
+	extractFrame func(src io.Reader, offset *float64) ([]byte, error)
+}
+
+func newFakeMedia() *fakeMedia {
+	return &fakeMedia{}
+}
+
+// fakeFormatNames are what ffprobe calls each container family.
+var fakeFormatNames = map[string]string{
+	containerISOBMFF:  "mov,mp4,m4a,3gp,3g2,mj2",
+	containerMatroska: "matroska,webm",
+	containerAVI:      "avi",
+}
+
+func (f *fakeMedia) Probe(ctx context.Context, filePath string) (ffprobeOutput, error) {
+	if f.probe != nil {
+		return f.probe(filePath)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	head, err := readVideoHeader(file)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	formatName, ok := fakeFormatNames[sniffVideoContainer(head)]
+	if !ok {
+		// What ffprobe does with a file it can't read.
+		return ffprobeOutput{}, &ffmpegError{
+			Program:  "ffprobe",
+			Op:       "probe",
+			ExitCode: 1,
+			Stderr:   filePath + ": Invalid data found when processing input",
+			Err:      errors.New("exit status 1"),
+		}
+	}
+
+	return ffprobeOutput{
+		Streams: []ffprobeStream{
+			{
+				CodecType:    "video",
+				CodecName:    "h264",
+				PixFmt:       "yuv420p",
+				Width:        1920,
+				Height:       1080,
+				AvgFrameRate: "30/1",
+				RFrameRate:   "30/1",
+			},
+			{CodecType: "audio", CodecName: "aac"},
+		},
+		Format: ffprobeFormat{
+			FormatName: formatName,
+			Duration:   strconv.FormatFloat(fakeMediaDuration, 'f', 6, 64),
+			Size:       strconv.FormatInt(info.Size(), 10),
+		},
+	}, nil
+}
+
+func (f *fakeMedia) Normalize(ctx context.Context, filePath string, input ffprobeOutput) (string, error) {
+	if f.normalize != nil {
+		return f.normalize(filePath, input)
+	}
+
+	outputPath := filePath + ".processing"
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(outputPath, data, 0644)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+func (f *fakeMedia) TranscodeHLS(ctx context.Context, filePath, outputDir string, rendition hlsRendition) error {
+	if f.transcodeHLS != nil {
+		return f.transcodeHLS(filePath, outputDir, rendition)
+	}
+
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.1f,\nsegment_00000.ts\n#EXT-X-ENDLIST\n", fakeMediaDuration)
+	err := os.WriteFile(filepath.Join(outputDir, "index.m3u8"), []byte(playlist), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, "segment_00000.ts"), nil, 0644)
+}
+
+func (f *fakeMedia) ExtractFrame(ctx context.Context, src io.Reader, offset *float64) ([]byte, error) {
+	if f.extractFrame != nil {
+		return f.extractFrame(src, offset)
+	}
+
+	if offset != nil && *offset >= fakeMediaDuration {
+		return nil, errors.New("no frame at that position")
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, 320, 180))
+	draw.Draw(frame, frame.Bounds(), image.NewUniform(color.Gray{Y: 0x80}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everything that looks inside or rewrites media goes through a
+// mediaProber or a transcoder, so the rest of the server doesn't depend on
+// ffmpeg being installed. MEDIA_BACKEND picks ffmpeg (the default) or a fake
+// for running without it.
+
+// mediaProber reads what's in a media file.
+type mediaProber interface {
+	Probe(ctx context.Context, filePath string) (ffprobeOutput, error)
+}
+
+// transcoder writes media files.
+type transcoder interface {
+	// Normalize writes the probed input as a faststart H.264/AAC MP4 and
+	// returns its path.
+	Normalize(ctx context.Context, filePath string, input ffprobeOutput) (string, error)
+	// TranscodeHLS writes one rendition of the input to outputDir as an
+	// index.m3u8 playlist and its segments.
+	TranscodeHLS(ctx context.Context, filePath, outputDir string, rendition hlsRendition) error
+	// ExtractFrame reads a video from src and returns a single JPEG frame,
+	// at offset seconds or, if it's nil, a representative one near the
+	// start.
+	ExtractFrame(ctx context.Context, src io.Reader, offset *float64) ([]byte, error)
+}
+
+func newMediaBackend(name string, limits ffmpegLimits) (mediaProber, transcoder, error) {
+	switch name {
+	case "", "ffmpeg":
+		media := newFFmpegMedia(limits)
+		return media, media, nil
+	case "fake":
+		fake := newFakeMedia()
+		return fake, fake, nil
+	}
+	return nil, nil, fmt.Errorf("unknown MEDIA_BACKEND %q", name)
+}
+
+// ffmpegLimits keeps ffmpeg from taking over the machine, or hanging on a
+// file it can't make sense of.
+type ffmpegLimits struct {
+	// Concurrency is how many ffmpeg and ffprobe processes may run at once.
+	// Others wait their turn.
+	Concurrency int
+	// Threads caps the threads each process uses. 0 lets ffmpeg decide.
+	Threads int
+	// Nice lowers the processes' scheduling priority so the API stays
+	// responsive while they run. 0 leaves it alone.
+	Nice int
+	// The timeouts bound each kind of run, not counting the wait for a
+	// turn.
+	ProbeTimeout     time.Duration
+	TranscodeTimeout time.Duration
+	FrameTimeout     time.Duration
+}
+
+var defaultFFmpegLimits = ffmpegLimits{
+	Concurrency:      2,
+	Nice:             10,
+	ProbeTimeout:     time.Minute,
+	TranscodeTimeout: 2 * time.Hour,
+	FrameTimeout:     time.Minute,
+}
+
+// ffmpegStderrLimit is how much of the end of ffmpeg's stderr is kept for
+// errors. The end is where it says what went wrong.
+const ffmpegStderrLimit = 4 << 10
+
+// ffmpegError is a failed ffmpeg or ffprobe run.
+type ffmpegError struct {
+	// Program is "ffmpeg" or "ffprobe", and Op what it was doing.
+	Program string
+	Op      string
+	// ExitCode is -1 if the process didn't exit on its own, e.g. because it
+	// timed out.
+	ExitCode int
+	// Stderr is the end of what the process logged.
+	Stderr string
+	Err    error
+}
+
+func (e *ffmpegError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Program, e.Op, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *ffmpegError) Unwrap() error { return e.Err }
+
+// ffmpegMedia runs the ffprobe and ffmpeg found on the PATH.
+type ffmpegMedia struct {
+	limits ffmpegLimits
+	// slots holds a token for every running process.
+	slots chan struct{}
+}
+
+func newFFmpegMedia(limits ffmpegLimits) *ffmpegMedia {
+	return &ffmpegMedia{
+		limits: limits,
+		slots:  make(chan struct{}, limits.Concurrency),
+	}
+}
+
+// run runs program once there's a free slot, killing it if it takes longer
+// than timeout or ctx is done first.
+func (m *ffmpegMedia) run(ctx context.Context, op string, timeout time.Duration, program string, args []string, stdin io.Reader, stdout io.Writer) error {
+	select {
+	case m.slots <- struct{}{}:
+		defer func() { <-m.slots }()
+	case <-ctx.Done():
+		return &ffmpegError{Program: program, Op: op, ExitCode: -1, Err: ctx.Err()}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := program
+	if m.limits.Nice > 0 {
+		if nice, err := exec.LookPath("nice"); err == nil {
+			name = nice
+			args = append([]string{"-n", strconv.Itoa(m.limits.Nice), program}, args...)
+		}
+	}
+	stderr := &tailBuffer{limit: ffmpegStderrLimit}
+	cmd := exec.CommandContext(runCtx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Don't wait forever on pipes a killed process left open.
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	ffErr := &ffmpegError{Program: program, Op: op, ExitCode: -1, Stderr: stderr.String(), Err: err}
+	switch {
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+		ffErr.Err = fmt.Errorf("timed out after %s: %w", timeout, context.DeadlineExceeded)
+	case ctx.Err() != nil:
+		ffErr.Err = ctx.Err()
+	default:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			ffErr.ExitCode = exitErr.ExitCode()
+		}
+	}
+	return ffErr
+}
+
+// threadArgs are the output options that cap ffmpeg's threads.
+func (m *ffmpegMedia) threadArgs() []string {
+	if m.limits.Threads == 0 {
+		return nil
+	}
+	threads := strconv.Itoa(m.limits.Threads)
+	return []string{"-threads", threads, "-filter_threads", threads}
+}
+
+func (m *ffmpegMedia) Probe(ctx context.Context, filePath string) (ffprobeOutput, error) {
+	var buffer bytes.Buffer
+	args := []string{"-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath}
+	err := m.run(ctx, "probe", m.limits.ProbeTimeout, "ffprobe", args, nil, &buffer)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+
+	var data ffprobeOutput
+	err = json.Unmarshal(buffer.Bytes(), &data)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	return data, nil
+}
+
+// Normalize keeps only the first video and audio streams, and an input
+// that already conforms is just remuxed. Nothing is left behind if it
+// fails.
+func (m *ffmpegMedia) Normalize(ctx context.Context, filePath string, input ffprobeOutput) (string, error) {
+	outputPath := filePath + ".processing"
+
+	// "V" skips attached pictures such as cover art.
+	args := []string{"-v", "error", "-nostdin", "-y", "-i", filePath, "-map", "0:V:0", "-map", "0:a:0?"}
+	video, _ := input.videoStream()
+	if video.conformsToMP4() {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args,
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+			// 4:2:0 needs even dimensions.
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		)
+	}
+	if audio, ok := input.firstStream("audio"); ok && audio.CodecName == "aac" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args, m.threadArgs()...)
+	args = append(args, "-movflags", "faststart", "-f", "mp4", outputPath)
+
+	err := m.run(ctx, "normalize", m.limits.TranscodeTimeout, "ffmpeg", args, nil, nil)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+func (m *ffmpegMedia) TranscodeHLS(ctx context.Context, filePath, outputDir string, rendition hlsRendition) error {
+	bitrate := fmt.Sprintf("%dk", rendition.BitrateKbps)
+	args := []string{
+		"-v", "error", "-nostdin", "-y",
+		"-i", filePath,
+		"-vf", fmt.Sprintf("scale=-2:%d", rendition.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", bitrate,
+		"-maxrate", fmt.Sprintf("%dk", rendition.BitrateKbps*107/100),
+		"-bufsize", fmt.Sprintf("%dk", rendition.BitrateKbps*3/2),
+		"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", hlsAudioBitrateKbps), "-ac", "2",
+	}
+	args = append(args, m.threadArgs()...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, "segment_%05d.ts"),
+		filepath.Join(outputDir, "index.m3u8"),
+	)
+	return m.run(ctx, "hls "+rendition.name(), m.limits.TranscodeTimeout, "ffmpeg", args, nil, nil)
+}
+
+// ExtractFrame streams the video through ffmpeg's stdin so callers don't
+// need a local copy; this works because published MP4s are faststart.
+func (m *ffmpegMedia) ExtractFrame(ctx context.Context, src io.Reader, offset *float64) ([]byte, error) {
+	args := []string{"-v", "error"}
+	if offset != nil {
+		args = append(args, "-ss", strconv.FormatFloat(*offset, 'f', -1, 64))
+	}
+	args = append(args, "-i", "pipe:0")
+	if offset == nil {
+		args = append(args, "-vf", "thumbnail")
+	}
+	args = append(args, m.threadArgs()...)
+	args = append(args, "-frames:v", "1", "-q:v", "2", "-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+
+	var stdout bytes.Buffer
+	err := m.run(ctx, "frame", m.limits.FrameTimeout, "ffmpeg", args, src, &stdout)
+	if err != nil {
+		return nil, err
+	}
+	if stdout.Len() == 0 {
+		// ffmpeg exits cleanly when seeking past the end of the video.
+		return nil, errors.New("no frame at that position")
+	}
+	return stdout.Bytes(), nil
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.limit; over > 0 {
+		b.buf = b.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return strings.TrimSpace(string(b.buf))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Storage garbage collection compares what's in the stores with what the
+// database refers to. Objects nothing refers to are orphans; references to
+// objects that don't exist are dangling.
+
+const defaultGCGrace = 24 * time.Hour
+
+type gcOptions struct {
+	// Delete removes orphans last modified more than Grace ago. The grace
+	// period keeps uploads that haven't been recorded yet safe.
+	Delete bool
+	DryRun bool
+	Grace  time.Duration
+}
+
+type gcObject struct {
+	Store        string    `json:"store"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type gcDanglingRef struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Field   string    `json:"field"`
+	Store   string    `json:"store"`
+	Key     string    `json:"key"`
+}
+
+type gcReport struct {
+	Orphans     []gcObject      `json:"orphans"`
+	OrphanBytes int64           `json:"orphan_bytes"`
+	Dangling    []gcDanglingRef `json:"dangling"`
+	// Deleted lists the orphans that were removed, or would have been in a
+	// dry run.
+	Deleted []gcObject `json:"deleted"`
+	DryRun  bool       `json:"dry_run"`
+	Errors  []string   `json:"errors"`
+}
+
+// gcRefs is what the database refers to in one store: exact keys, and
+// prefixes that cover whole directories such as HLS renditions.
+type gcRefs struct {
+	keys     map[string]bool
+	prefixes map[string]bool
+}
+
+func newGCRefs() gcRefs {
+	return gcRefs{keys: map[string]bool{}, prefixes: map[string]bool{}}
+}
+
+func (r gcRefs) covers(key string) bool {
+	if r.keys[key] {
+		return true
+	}
+	for i, c := range key {
+		if c == '/' && r.prefixes[key[:i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r gcRefs) add(key string) {
+	if strings.HasSuffix(key, "/") {
+		r.prefixes[key] = true
+		return
+	}
+	r.keys[key] = true
+}
+
+// gcStoreName is the store a reference is checked against. With the local
+// backend, videos and assets share one directory.
+func (cfg *apiConfig) gcStoreName(name string) string {
+	if name == deletionStoreAsset && cfg.assetStore == cfg.videoStore {
+		return deletionStoreVideo
+	}
+	return name
+}
+
+func (cfg *apiConfig) collectGarbage(ctx context.Context, opts gcOptions) (gcReport, error) {
+	report := gcReport{
+		Orphans:  []gcObject{},
+		Dangling: []gcDanglingRef{},
+		Deleted:  []gcObject{},
+		DryRun:   opts.DryRun,
+		Errors:   []string{},
+	}
+
+	refs := map[string]gcRefs{}
+	var storeNames []string
+	for _, store := range []string{deletionStoreVideo, deletionStoreAsset} {
+		store = cfg.gcStoreName(store)
+		if _, ok := refs[store]; !ok {
+			refs[store] = newGCRefs()
+			storeNames = append(storeNames, store)
+		}
+	}
+	ref := func(store, key string) {
+		refs[cfg.gcStoreName(store)].add(key)
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return report, err
+	}
+	var dangling []gcDanglingRef
+	for _, video := range videos {
+		if video.VideoKey != nil {
+			ref(deletionStoreVideo, *video.VideoKey)
+			// Renditions are written here before the video points at them.
+			ref(deletionStoreVideo, hlsPrefix(*video.VideoKey)+"/")
+			dangling = append(dangling, gcDanglingRef{VideoID: video.ID, Field: "video_key", Store: deletionStoreVideo, Key: *video.VideoKey})
+		}
+		if video.HLSKey != nil {
+			ref(deletionStoreVideo, path.Dir(*video.HLSKey)+"/")
+			dangling = append(dangling, gcDanglingRef{VideoID: video.ID, Field: "hls_key", Store: deletionStoreVideo, Key: *video.HLSKey})
+		}
+		if video.ThumbnailKey != nil {
+			ref(deletionStoreVideo, *video.ThumbnailKey)
+			dangling = append(dangling, gcDanglingRef{VideoID: video.ID, Field: "thumbnail_key", Store: deletionStoreVideo, Key: *video.ThumbnailKey})
+		}
+		if key, ok := cfg.legacyThumbnailKey(video); ok {
+			ref(deletionStoreAsset, key)
+			dangling = append(dangling, gcDanglingRef{VideoID: video.ID, Field: "thumbnail_url", Store: deletionStoreAsset, Key: key})
+		}
+	}
+
+	jobs, err := cfg.db.UnfinishedJobs(jobKindProcessVideo)
+	if err != nil {
+		return report, err
+	}
+	for _, job := range jobs {
+		var payload processVideoPayload
+		if json.Unmarshal([]byte(job.Payload), &payload) == nil {
+			for _, key := range payload.sourceKeys() {
+				if key != "" {
+					ref(deletionStoreVideo, key)
+				}
+			}
+		}
+	}
+
+	uploads, err := cfg.db.GetAllUploads()
+	if err != nil {
+		return report, err
+	}
+	for _, upload := range uploads {
+		ref(deletionStoreVideo, uploadPrefix(upload.ID))
+	}
+
+	// Files already queued for deletion are taken care of.
+	pending, err := cfg.db.ListPendingDeletions()
+	if err != nil {
+		return report, err
+	}
+	for _, deletion := range pending {
+		ref(deletion.Store, deletion.Key)
+	}
+
+	existing := map[string]map[string]bool{}
+	cutoff := time.Now().Add(-opts.Grace)
+	for _, storeName := range storeNames {
+		storeRefs := refs[storeName]
+		store, err := cfg.deletionStore(storeName)
+		if err != nil {
+			return report, err
+		}
+		objects, err := store.List(ctx, "")
+		if err != nil {
+			return report, fmt.Errorf("couldn't list %s store: %w", storeName, err)
+		}
+
+		existing[storeName] = map[string]bool{}
+		for _, obj := range objects {
+			existing[storeName][obj.Key] = true
+			if storeRefs.covers(obj.Key) {
+				continue
+			}
+			orphan := gcObject{Store: storeName, Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}
+			report.Orphans = append(report.Orphans, orphan)
+			report.OrphanBytes += obj.Size
+
+			if !opts.Delete || obj.LastModified.After(cutoff) {
+				continue
+			}
+			if !opts.DryRun {
+				err := store.Delete(ctx, obj.Key)
+				if err != nil && !errors.Is(err, storage.ErrNotFound) {
+					report.Errors = append(report.Errors, fmt.Sprintf("couldn't delete %s from %s store: %v", obj.Key, storeName, err))
+					continue
+				}
+			}
+			report.Deleted = append(report.Deleted, orphan)
+		}
+	}
+
+	for _, d := range dangling {
+		d.Store = cfg.gcStoreName(d.Store)
+		if !existing[d.Store][d.Key] {
+			report.Dangling = append(report.Dangling, d)
+		}
+	}
+	return report, nil
+}
+
+func (cfg *apiConfig) handlerGC(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Delete bool   `json:"delete"`
+		DryRun bool   `json:"dry_run"`
+		Grace  string `json:"grace"`
+	}
+
+	if !cfg.checkAdminAPIKey(w, r) {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	opts := gcOptions{Delete: params.Delete, DryRun: params.DryRun, Grace: defaultGCGrace}
+	if params.Grace != "" {
+		opts.Grace, err = time.ParseDuration(params.Grace)
+		if err != nil || opts.Grace < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid grace period", err)
+			return
+		}
+	}
+
+	report, err := cfg.collectGarbage(r.Context(), opts)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't collect garbage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// checkAdminAPIKey only lets through requests carrying ADMIN_API_KEY. The
+// admin API is off when it isn't set.
+func (cfg *apiConfig) checkAdminAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled", nil)
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return false
+	}
+	return true
+}
+
+func runGCCommand(pathToDB string, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	deleteOrphans := flags.Bool("delete", false, "delete orphans older than the grace period")
+	dryRun := flags.Bool("dry-run", false, "with -delete, list what would be deleted without deleting it")
+	grace := flags.Duration("grace", defaultGCGrace, "how old an orphan must be to be deleted")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := commandConfig(pathToDB)
+	if errors.Is(err, errMemoryBackend) {
+		return fmt.Errorf("%w; use POST /admin/gc instead", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), gcOptions{
+		Delete: *deleteOrphans,
+		DryRun: *dryRun,
+		Grace:  *grace,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printGCReport(report)
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d orphans couldn't be deleted", len(report.Errors))
+	}
+	return nil
+}
+
+func printGCReport(report gcReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ORPHANS (%d, %d bytes)\n", len(report.Orphans), report.OrphanBytes)
+	fmt.Fprintln(tw, "STORE\tKEY\tSIZE\tLAST MODIFIED")
+	for _, obj := range report.Orphans {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", obj.Store, obj.Key, obj.Size, obj.LastModified.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(tw, "\nDANGLING REFERENCES (%d)\n", len(report.Dangling))
+	fmt.Fprintln(tw, "VIDEO\tFIELD\tSTORE\tKEY")
+	for _, d := range report.Dangling {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.VideoID, d.Field, d.Store, d.Key)
+	}
+	tw.Flush()
+
+	if len(report.Deleted) > 0 {
+		verb := "Deleted"
+		if report.DryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("\n%s %d orphans\n", verb, len(report.Deleted))
+	}
+	for _, msg := range report.Errors {
+		fmt.Println(msg)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Resumable video uploads following the tus 1.0 protocol
+// (https://tus.io/protocols/resumable-upload), with the creation,
+// termination and expiration extensions. Each chunk is stored as a part in
+// the video store and recorded with the upload's offset in the database, and
+// requests lock the upload in the database, so it doesn't matter which
+// instance a request lands on. Once the last byte arrives the parts go
+// through the same pipeline as a regular upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	// maxResumableUploadSize is larger than the limit on regular uploads
+	// since a tus upload never has to fit in one request.
+	maxResumableUploadSize = 10 << 30
+
+	uploadJanitorInterval = 10 * time.Minute
+	uploadLockLease       = 2 * time.Minute
+)
+
+// errUploadChanged means another request moved the upload on first.
+var errUploadChanged = errors.New("upload was changed by another request")
+
+// lockUpload keeps other requests off an upload, on any instance, until the
+// returned func is called. It returns false if another request has it.
+func (cfg *apiConfig) lockUpload(id uuid.UUID) (unlock func(), ok bool, err error) {
+	token := uuid.New()
+	ok, err = cfg.db.LockUpload(id, token, uploadLockLease)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cfg.heartbeatUploadLock(ctx, id, token)
+	return func() {
+		cancel()
+		err := cfg.db.UnlockUpload(id, token)
+		if err != nil {
+			log.Printf("Couldn't unlock upload %s: %v", id, err)
+		}
+	}, true, nil
+}
+
+func (cfg *apiConfig) heartbeatUploadLock(ctx context.Context, id, token uuid.UUID) {
+	ticker := time.NewTicker(uploadLockLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := cfg.db.ExtendUploadLock(id, token, uploadLockLease)
+			if err != nil {
+				log.Printf("Couldn't extend lock on upload %s: %v", id, err)
+			}
+		}
+	}
+}
+
+func uploadPrefix(id uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", id)
+}
+
+// uploadFiles lists what's stored for an upload.
+func uploadFiles(id uuid.UUID) []database.CreatePendingDeletionParams {
+	return []database.CreatePendingDeletionParams{
+		{Store: deletionStoreVideo, Key: uploadPrefix(id)},
+	}
+}
+
+// checkTusResumable rejects requests from clients speaking another version
+// of the protocol.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxResumableUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length must be a positive number", err)
+		return
+	}
+	if length > maxResumableUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload is too large", nil)
+		return
+	}
+
+	rawMetadata := r.Header.Get("Upload-Metadata")
+	metadata, err := parseUploadMetadata(rawMetadata)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must include a valid video_id", err)
+		return
+	}
+	if filetype := metadata["filetype"]; filetype != "" {
+		if _, ok := parseVideoType(filetype); !ok {
+			respondWithError(w, http.StatusBadRequest, unsupportedVideoTypeMessage, nil)
+			return
+		}
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		VideoID:   videoID,
+		UserID:    userID,
+		Length:    length,
+		Metadata:  rawMetadata,
+		ExpiresAt: time.Now().Add(cfg.uploadExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// keys, each followed by a space and a base64 encoded value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// getOwnedUpload loads the upload named in the path for its owner, and
+// writes the error response if that fails.
+func (cfg *apiConfig) getOwnedUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.Upload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Upload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Upload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't access this upload", nil)
+		return database.Upload{}, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload has expired", nil)
+		return database.Upload{}, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset must be a number", err)
+		return
+	}
+
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	unlock, locked, err := cfg.lockUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock upload", err)
+		return
+	}
+	if !locked {
+		respondWithError(w, http.StatusLocked, "Upload is busy with another request", nil)
+		return
+	}
+	defer unlock()
+
+	// Another request may have moved it on before the lock was taken.
+	upload, err = cfg.db.GetUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the upload", nil)
+		return
+	}
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk goes past the end of the upload", nil)
+		return
+	}
+
+	startOffset := upload.Offset
+	if remaining > 0 {
+		upload, err = cfg.appendToUpload(upload, io.LimitReader(r.Body, remaining))
+		if errors.Is(err, errUploadChanged) {
+			respondWithError(w, http.StatusConflict, "Upload was changed by another request", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save upload chunk", err)
+			return
+		}
+	}
+
+	// Turn away uploads that aren't a video as soon as there's enough to
+	// tell, rather than after the whole file.
+	sniffAt := min(videoSniffLen, upload.Length)
+	if startOffset < sniffAt && upload.Offset >= sniffAt {
+		err := cfg.checkStagedUpload(r.Context(), upload)
+		if err != nil {
+			var uploadErr *uploadError
+			if errors.As(err, &uploadErr) {
+				err = errors.Join(err, cfg.removeUpload(upload))
+			}
+			respondWithUploadError(w, "Invalid video file", err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	// A client whose last PATCH failed after all bytes were saved can
+	// send an empty one to retry this.
+	if upload.Offset == upload.Length {
+		job, err := cfg.finishUpload(upload)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video processing", err)
+			return
+		}
+		// Lets the web app follow processing like it does for regular
+		// uploads.
+		w.Header().Set("Tubely-Job-ID", job.ID.String())
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendToUpload stores what's read from body as the upload's next part,
+// and returns the upload moved past it. Whatever arrived counts, even if the
+// connection dropped, so the client can resume from there.
+func (cfg *apiConfig) appendToUpload(upload database.Upload, body io.Reader) (database.Upload, error) {
+	// Only what arrives can be stored, so the chunk is buffered first.
+	buffered, err := os.CreateTemp(cfg.uploadsDir, "chunk-*")
+	if err != nil {
+		return upload, err
+	}
+	defer os.Remove(buffered.Name())
+	defer buffered.Close()
+
+	written, readErr := io.Copy(buffered, body)
+	if written == 0 {
+		return upload, readErr
+	}
+	_, err = buffered.Seek(0, io.SeekStart)
+	if err != nil {
+		return upload, err
+	}
+
+	name, err := randomName()
+	if err != nil {
+		return upload, err
+	}
+	part := database.UploadPart{
+		UploadID: upload.ID,
+		Offset:   upload.Offset,
+		Size:     written,
+		Key:      fmt.Sprintf("%s%020d-%s", uploadPrefix(upload.ID), upload.Offset, name),
+	}
+	// The request's context ends when the connection drops, and what
+	// arrived before that is still kept.
+	ctx := context.Background()
+	err = cfg.videoStore.Put(ctx, part.Key, io.LimitReader(buffered, written), "application/octet-stream")
+	if err != nil {
+		return upload, err
+	}
+
+	expiresAt := time.Now().Add(cfg.uploadExpiry)
+	added, err := cfg.db.AddUploadPart(part, expiresAt)
+	if err == nil && !added {
+		err = errUploadChanged
+	}
+	if err != nil {
+		deleteErr := cfg.videoStore.Delete(ctx, part.Key)
+		if deleteErr != nil {
+			log.Printf("Couldn't delete unrecorded part %s: %v", part.Key, deleteErr)
+		}
+		return upload, err
+	}
+	upload.Offset += written
+	upload.ExpiresAt = expiresAt
+	return upload, readErr
+}
+
+// openStagedUpload reads back the bytes an upload has received so far.
+func (cfg *apiConfig) openStagedUpload(ctx context.Context, upload database.Upload) (io.ReadCloser, error) {
+	keys, err := cfg.stagedUploadKeys(upload)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedUploadReader{ctx: ctx, store: cfg.videoStore, keys: keys}, nil
+}
+
+// stagedUploadKeys lists the keys of an upload's parts in order, making
+// sure together they hold every byte it has received.
+func (cfg *apiConfig) stagedUploadKeys(upload database.Upload) ([]string, error) {
+	parts, err := cfg.db.UploadParts(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	var next int64
+	for _, part := range parts {
+		if part.Offset != next {
+			return nil, fmt.Errorf("upload %s is missing bytes %d to %d", upload.ID, next, part.Offset)
+		}
+		keys = append(keys, part.Key)
+		next += part.Size
+	}
+	if next != upload.Offset {
+		return nil, fmt.Errorf("upload %s has parts up to %d, but its offset is %d", upload.ID, next, upload.Offset)
+	}
+	return keys, nil
+}
+
+// stagedUploadReader reads an upload's parts one after another, opening
+// each only once it's reached.
+type stagedUploadReader struct {
+	ctx   context.Context
+	store storage.BlobStore
+	keys  []string
+	part  io.ReadCloser
+}
+
+func (r *stagedUploadReader) Read(p []byte) (int, error) {
+	for {
+		if r.part == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			part, err := r.store.Get(r.ctx, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.part, r.keys = part, r.keys[1:]
+		}
+
+		n, err := r.part.Read(p)
+		if err == io.EOF {
+			err = r.part.Close()
+			r.part = nil
+			if n == 0 && err == nil {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (r *stagedUploadReader) Close() error {
+	if r.part == nil {
+		return nil
+	}
+	return r.part.Close()
+}
+
+// finishUpload hands a complete upload to the processing pipeline. The job
+// reads the parts where they are and deletes them when it's done, so the
+// client gets its answer without waiting for the file to be copied.
+func (cfg *apiConfig) finishUpload(upload database.Upload) (database.Job, error) {
+	keys, err := cfg.stagedUploadKeys(upload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	// Without a type, the worker works out what the file is.
+	job, err := cfg.enqueueUploadProcessing(upload.VideoID, keys, uploadMediaType(upload))
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	// The parts belong to the job now, so only the upload is forgotten.
+	err = cfg.db.DeleteUpload(upload.ID, nil)
+	if err != nil {
+		return database.Job{}, err
+	}
+	return job, nil
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	unlock, locked, err := cfg.lockUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock upload", err)
+		return
+	}
+	if !locked {
+		respondWithError(w, http.StatusLocked, "Upload is busy with another request", nil)
+		return
+	}
+	defer unlock()
+
+	err = cfg.removeUpload(upload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadMediaType is the video type the upload was created with, or "" if
+// the client didn't say.
+func uploadMediaType(upload database.Upload) string {
+	metadata, _ := parseUploadMetadata(upload.Metadata)
+	mediaType, ok := parseVideoType(metadata["filetype"])
+	if !ok {
+		return ""
+	}
+	return mediaType
+}
+
+// checkStagedUpload checks the start of a staged upload against the type it
+// was created with.
+func (cfg *apiConfig) checkStagedUpload(ctx context.Context, upload database.Upload) error {
+	staged, err := cfg.openStagedUpload(ctx, upload)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+	head, err := readVideoHeader(staged)
+	if err != nil {
+		return err
+	}
+	return checkVideoHeader(head, uploadMediaType(upload))
+}
+
+// removeUpload forgets an upload and has its parts deleted.
+func (cfg *apiConfig) removeUpload(upload database.Upload) error {
+	err := cfg.db.DeleteUpload(upload.ID, uploadFiles(upload.ID))
+	if err != nil {
+		return err
+	}
+	cfg.wakeDeleter()
+	return nil
+}
+
+// expireUploads periodically removes uploads that were abandoned.
+func (cfg *apiConfig) expireUploads(ctx context.Context) {
+	ticker := time.NewTicker(uploadJanitorInterval)
+	defer ticker.Stop()
+	for {
+		uploads, err := cfg.db.ExpiredUploads(time.Now())
+		if err != nil {
+			log.Printf("Couldn't list expired uploads: %v", err)
+		}
+		for _, upload := range uploads {
+			unlock, locked, err := cfg.lockUpload(upload.ID)
+			if err != nil {
+				log.Printf("Couldn't lock expired upload %s: %v", upload.ID, err)
+				continue
+			}
+			if !locked {
+				continue
+			}
+			err = cfg.removeUpload(upload)
+			unlock()
+			if err != nil {
+				log.Printf("Couldn't remove expired upload %s: %v", upload.ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
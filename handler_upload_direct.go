@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Direct uploads let the browser send a video straight to the bucket, so it
+// doesn't pass through the API server on the way in. The client asks for a
+// presigned form, posts the file to S3 and then tells us it's done.
+
+// directUploadExpiry is how long a client has to start sending the file.
+const directUploadExpiry = time.Hour
+
+// ownedVideoID authenticates the request and checks that the caller owns the
+// video in the path, writing the error response if not.
+func (cfg *apiConfig) ownedVideoID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return uuid.Nil, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return uuid.Nil, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return uuid.Nil, false
+	}
+	return videoID, true
+}
+
+func (cfg *apiConfig) handlerDirectUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	type response struct {
+		storage.PresignedPost
+		Key       string    `json:"key"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoID, ok := cfg.ownedVideoID(w, r)
+	if !ok {
+		return
+	}
+	presigner, ok := cfg.videoStore.(storage.Presigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	mediaType, ok := parseVideoType(params.ContentType)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, unsupportedVideoTypeMessage, nil)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Size must be a positive number", nil)
+		return
+	}
+	if params.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	key, err := newOriginalKey(videoID, mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	// S3 refuses anything bigger than the client said it would send.
+	post, err := presigner.PresignPost(r.Context(), key, mediaType, params.Size, directUploadExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		PresignedPost: post,
+		Key:           key,
+		ExpiresAt:     time.Now().Add(directUploadExpiry).UTC(),
+	})
+}
+
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	videoID, ok := cfg.ownedVideoID(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	// Only accept keys we could have handed out for this video.
+	name, ok := strings.CutPrefix(params.Key, originalsPrefix(videoID))
+	if !ok || name == "" || strings.Contains(name, "/") {
+		respondWithError(w, http.StatusBadRequest, "Invalid key", nil)
+		return
+	}
+
+	info, err := cfg.videoStore.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Nothing was uploaded to this key", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	// The presigned policy enforces these, but the object is only trusted
+	// once we've seen it ourselves.
+	mediaType, ok := parseVideoType(info.ContentType)
+	if info.Size > maxVideoUploadSize || !ok {
+		cfg.videoStore.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusBadRequest, "Uploaded file isn't an acceptable video", nil)
+		return
+	}
+	err = cfg.checkStoredVideoHeader(r.Context(), params.Key, mediaType)
+	if err != nil {
+		var uploadErr *uploadError
+		if errors.As(err, &uploadErr) {
+			cfg.videoStore.Delete(r.Context(), params.Key)
+		}
+		respondWithUploadError(w, "Invalid video file", err)
+		return
+	}
+
+	job, err := cfg.enqueueVideoProcessing(videoID, params.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// checkStoredVideoHeader checks the start of an uploaded object against the
+// type it was uploaded as.
+func (cfg *apiConfig) checkStoredVideoHeader(ctx context.Context, key, mediaType string) error {
+	body, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	head, err := readVideoHeader(body)
+	if err != nil {
+		return err
+	}
+	return checkVideoHeader(head, mediaType)
+}
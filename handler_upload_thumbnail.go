@@ -1,20 +1,19 @@
 package main
 
 import (
-	"fmt"
-	"net/http"
+	"bytes"
 	"io"
-	"path/filepath"
-	"crypto/rand"
-	"encoding/base64"
-	"strings"
-	"os"
 	"mime"
+	"net/http"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
+// maxThumbnailSize caps uploaded thumbnails, which are checked in memory.
+const maxThumbnailSize = 10 << 20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -35,95 +34,136 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	metadata, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get metadata", err)
+		return
+	}
+	if metadata.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if metadata.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
-	const maxMemory = 10 << 20  // 10 * 2^20 = 10 * 1024 * 1024 = 10MB
+	const maxMemory = 10 << 20 // 10 * 2^20 = 10 * 1024 * 1024 = 10MB
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
-    respondWithError(w, http.StatusBadRequest, "Couldn't parse data", err)
-    return
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse data", err)
+		return
 	}
 
 	uploadedFile, fileHeader, err := r.FormFile("thumbnail")
 	if err != nil {
-    respondWithError(w, http.StatusBadRequest, "Couldn't get data", err)
-    return
+		respondWithError(w, http.StatusBadRequest, "Couldn't get data", err)
+		return
 	}
 	defer uploadedFile.Close()
 
 	rawData := fileHeader.Header.Get("Content-Type")
 	if rawData == "" {
-    respondWithError(w, http.StatusBadRequest, "Missing Content-Type for thumbnail", nil)
-    return
+		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for thumbnail", nil)
+		return
 	}
 
 	mediaType, _, err := mime.ParseMediaType(rawData)
 	if err != nil {
-    respondWithError(w, http.StatusBadRequest, "Couldn't parse data", err)
-    return
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse data", err)
+		return
 	}
 
 	if mediaType != "image/jpeg" && mediaType != "image/png" {
-    respondWithError(w, http.StatusBadRequest, "Wrong file type", err)
-    return
+		respondWithError(w, http.StatusBadRequest, "Wrong file type", err)
+		return
 	}
 
-	// From the strings package - splitting by delimiter
-	mediaTypeParts := strings.Split(mediaType, "/")
-	// parts = ["image", "png"]
-
-	// Make a 32-byte slice
-	randomBytes := make([]byte, 32)
-
-	// Fill with random data
-	_, err = rand.Read(randomBytes)
+	data, err := io.ReadAll(io.LimitReader(uploadedFile, maxThumbnailSize+1))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't generate random bytes", err)
-    return
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail", err)
+		return
+	}
+	if len(data) > maxThumbnailSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", nil)
+		return
+	}
+	err = checkImage(data, mediaType)
+	if err != nil {
+		respondWithUploadError(w, "Invalid thumbnail", err)
+		return
 	}
 
-	// Encode to base64 string
-	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
-
-	// Create filename with extension
-	filename := fmt.Sprintf("%s.%s", randomString, mediaTypeParts[1])
+	key, err := cfg.saveThumbnail(r.Context(), bytes.NewReader(data), mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+	cfg.respondWithThumbnail(w, r, videoID, key)
+}
 
-	fullPath := filepath.Join(cfg.assetsRoot, filename)
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
 
-	diskFile, err := os.Create(fullPath)
+	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't create file", nil)
-    return
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
 	}
-	defer diskFile.Close()
 
-	_, err = io.Copy(diskFile, uploadedFile)
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-    respondWithError(w, http.StatusInternalServerError, "Couldn't get data", err)
-    return
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	offset, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "t must be a non-negative number of seconds", err)
+		return
 	}
 
 	metadata, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-    respondWithError(w, http.StatusInternalServerError, "Couldn't get metadata", err)
-    return
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get metadata", err)
+		return
+	}
+	if metadata.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
 	}
-
 	if metadata.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
-    return
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
 	}
 
-	url := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	metadata.ThumbnailURL = &url
+	if metadata.VideoKey == nil {
+		respondWithError(w, http.StatusConflict, "Video has no processed file yet", nil)
+		return
+	}
 
-	err = cfg.db.UpdateVideo(metadata)
+	videoFile, err := cfg.videoStore.Get(r.Context(), *metadata.VideoKey)
 	if err != nil {
-    respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-    return
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video", err)
+		return
 	}
+	defer videoFile.Close()
 
-	respondWithJSON(w, http.StatusOK, metadata)
+	frame, err := cfg.transcoder.ExtractFrame(r.Context(), videoFile, &offset)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't extract frame", err)
+		return
+	}
+
+	key, err := cfg.saveThumbnail(r.Context(), bytes.NewReader(frame), "image/jpeg")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+	cfg.respondWithThumbnail(w, r, videoID, key)
 }
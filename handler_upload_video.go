@@ -1,26 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
-	"crypto/rand"
-	"net/http"
 	"context"
-	"mime"
 	"fmt"
-	"os"
-	"os/exec"
 	"io"
+	"net/http"
 
-	"github.com/google/uuid"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+// maxVideoUploadSize caps uploads that are sent in a single request.
+const maxVideoUploadSize = 1 << 30
+
+const unsupportedVideoTypeMessage = "Unsupported video type, expected MP4, MOV, WebM, MKV or AVI"
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, 1 << 30)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -65,154 +62,67 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	mediaType, _, err := mime.ParseMediaType(rawData)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse data", err)
+	mediaType, ok := parseVideoType(rawData)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, unsupportedVideoTypeMessage, nil)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Wrong file type", err)
-		return
-	}
-
-	// Create temp file
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	// Turn away files that aren't what they claim before storing them.
+	head, err := readVideoHeader(uploadedFile)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't create temp file", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read video", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())  // Delete file when done
-	defer tempFile.Close()            // Close file when done (runs BEFORE remove)
-
-	// Copy data from somewhere to temp file
-	_, err = io.Copy(tempFile, uploadedFile)
+	err = checkVideoHeader(head, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't copy video data to temp file", err)
+		respondWithUploadError(w, "Invalid video file", err)
 		return
 	}
-
-	_, err = tempFile.Seek(0, io.SeekStart)
+	_, err = uploadedFile.Seek(0, io.SeekStart)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't reset the file pointer", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video", err)
 		return
 	}
 
-	// Generate random filename
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
+	job, err := cfg.queueUploadedVideo(r.Context(), videoID, uploadedFile, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't generate random bytes struct", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video processing", err)
 		return
 	}
 
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get aspect ratio", err)
-		return
-	}
-	randomName := base64.RawURLEncoding.EncodeToString(randomBytes)
-	fileKey := fmt.Sprintf("%s/%s.mp4", aspectRatio, randomName)
-
-	processedOutputPath, err := processVideoForFastStart(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get processedOutputPath", err)
-		return
-	}
-
-	// Open processed temp file
-	processedTempFile, err := os.Open(processedOutputPath)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't create processed temp file", err)
-		return
-	}
-	defer os.Remove(processedTempFile.Name())  // Delete file when done
-	defer processedTempFile.Close()
+	respondWithJSON(w, http.StatusAccepted, job)
+}
 
-	// Upload to S3
-	_, err = cfg.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(fileKey),
-		Body:        processedTempFile,  // This is an io.Reader!
-		ContentType: aws.String("video/mp4"),
-	})
+// queueUploadedVideo keeps the original in storage so the work survives a
+// restart, and queues it for the worker to pick up from there.
+func (cfg *apiConfig) queueUploadedVideo(ctx context.Context, videoID uuid.UUID, body io.Reader, mediaType string) (database.Job, error) {
+	sourceKey, err := newOriginalKey(videoID, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't upload to S3", err)
-		return
+		return database.Job{}, err
 	}
 
-	url := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, fileKey)
-	metadata.VideoURL = &url
-
-	err = cfg.db.UpdateVideo(metadata)
+	err = cfg.videoStore.Put(ctx, sourceKey, body, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		return database.Job{}, fmt.Errorf("couldn't store uploaded video: %w", err)
 	}
-
-	respondWithJSON(w, http.StatusOK, metadata)
+	return cfg.enqueueVideoProcessing(videoID, sourceKey)
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	// Create a buffer
-	var buffer bytes.Buffer
-
-	// Create a command
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-
-	// capture output by setting where it should write to
-	cmd.Stdout = &buffer
-
-	// Run it
-	err := cmd.Run()
+// newOriginalKey picks where a new upload to the video is kept until it's
+// processed.
+func newOriginalKey(videoID uuid.UUID, mediaType string) (string, error) {
+	name, err := randomName()
 	if err != nil {
 		return "", err
 	}
-
-	bytesData := buffer.Bytes()  // returns []byte
-
-	type stream struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
-	}
-
-	type ffprobe struct {
-    Streams []stream `json:"streams"`
-	}
-
-	var data ffprobe
-	err = json.Unmarshal(bytesData, &data)
-	if err != nil {
-		return "", err
-	}
-
-	firstStream := data.Streams[0]
-
-	ratio := float64(firstStream.Width) / float64(firstStream.Height)
-	targetRatio169 := 16.0 / 9.0
-	targetRatio916 := 9.0 / 16.0
-	tolerance := 0.1
-
-	if ratio >= targetRatio169 - tolerance && ratio <= targetRatio169 + tolerance {
-		return "landscape", nil // 16:9
-	} else if ratio >= targetRatio916 - tolerance && ratio <= targetRatio916 + tolerance {
-    return "portrait", nil // 9:16
-	} else {
-		return "other", nil
+	ext := ".bin"
+	if inputType, ok := videoInputTypes[mediaType]; ok {
+		ext = inputType.ext
 	}
+	return originalsPrefix(videoID) + name + ext, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
-	outputPath := filePath + ".processing"
-
-	// Create a command
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
-
-	// Run it
-	err := cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	return outputPath, nil
-}
\ No newline at end of file
+func originalsPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("originals/%s/", videoID)
+}
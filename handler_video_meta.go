@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -33,6 +38,15 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPrivate
+	}
+
+	err = validateVideoFields(params.Title, params.Description, params.Visibility)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -40,7 +54,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	respondWithJSON(w, http.StatusCreated, cfg.withMediaURLs(r, video))
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
@@ -72,15 +86,29 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.DeleteVideo(videoID, cfg.videoFiles(video), blobFiles)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.wakeDeleter()
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// optionalUserID returns the caller's user ID, or uuid.Nil if they didn't
+// send a token. A token that doesn't validate is still an error.
+func (cfg *apiConfig) optionalUserID(r *http.Request) (uuid.UUID, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if errors.Is(err, auth.ErrNoAuthHeaderIncluded) {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return auth.ValidateJWT(token, cfg.jwtSecret)
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -89,13 +117,32 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, err := cfg.optionalUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Private videos look the same as missing ones to everyone but their
+	// owner.
+	if video.ID == uuid.Nil || !video.VisibleTo(userID) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	r, err = cfg.setCloudFrontCookies(w, r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign CloudFront cookies", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, http.StatusOK, cfg.withMediaURLs(r, video))
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -110,11 +157,249 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	params, err := parseListVideosParams(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	params.UserID = userID
+
+	cfg.respondWithVideoPage(w, r, params)
+}
+
+// handlerVideosPublic lists everyone's public videos and needs no login.
+func (cfg *apiConfig) handlerVideosPublic(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListVideosParams(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	params.Visibility = database.VisibilityPublic
+
+	cfg.respondWithVideoPage(w, r, params)
+}
+
+func (cfg *apiConfig) respondWithVideoPage(w http.ResponseWriter, r *http.Request, params database.ListVideosParams) {
+	videos, next, err := cfg.db.ListVideos(params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	for i := range videos {
+		videos[i] = cfg.withMediaURLs(r, videos[i])
+	}
+
+	type response struct {
+		Videos     []database.Video `json:"videos"`
+		NextCursor *string          `json:"next_cursor"`
+	}
+	resp := response{Videos: videos}
+	if next != nil {
+		cursor, err := encodeVideoListCursor(videoListCursor{
+			Sort:        params.Sort,
+			Descending:  params.Descending,
+			VideoCursor: *next,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create cursor", err)
+			return
+		}
+		resp.NextCursor = &cursor
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+)
+
+func validateVideoFields(title, description string, visibility database.Visibility) error {
+	if strings.TrimSpace(title) == "" {
+		return errors.New("Title is required")
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return fmt.Errorf("Title must be at most %d characters", maxTitleLength)
+	}
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return fmt.Errorf("Description must be at most %d characters", maxDescriptionLength)
+	}
+	if !visibility.Valid() {
+		return errors.New("Visibility must be public, unlisted or private")
+	}
+	return nil
+}
+
+// videoETag changes whenever the video is saved, so clients can send it back
+// in If-Match to avoid overwriting someone else's edit.
+func videoETag(video database.Video) string {
+	return fmt.Sprintf(`"%d"`, video.UpdatedAt.UnixNano())
+}
+
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	// Nil fields are left unchanged.
+	type parameters struct {
+		Title       *string              `json:"title"`
+		Description *string              `json:"description"`
+		Visibility  *database.Visibility `json:"visibility"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	// Edits must say which version they're based on, or one client could
+	// silently overwrite another's changes.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header with the video's ETag is required", nil)
+		return
+	}
+	if !etagMatches(ifMatch, videoETag(video)) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed since you loaded it", nil)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		video.Visibility = *params.Visibility
+	}
+	err = validateVideoFields(video.Title, video.Description, video.Visibility)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, videos)
-}
\ No newline at end of file
+	// The If-Match check above used the copy we just read; this makes the
+	// save itself conditional in case another edit lands in between.
+	updated, err := cfg.db.UpdateVideoIfUnmodified(video, video.UpdatedAt)
+	if errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed since you loaded it", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(updated))
+	respondWithJSON(w, http.StatusOK, cfg.withMediaURLs(r, updated))
+}
+
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		respondWithError(w, http.StatusBadRequest, "q is required", nil)
+		return
+	}
+
+	limit := defaultVideosPageSize
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxVideosPageSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxVideosPageSize), err)
+			return
+		}
+	}
+
+	offset := 0
+	if raw := query.Get("cursor"); raw != "" {
+		offset, err = decodeSearchCursor(raw)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid cursor", err)
+			return
+		}
+	}
+
+	// Fetch one extra result to find out whether there's another page.
+	results, err := cfg.db.SearchVideos(database.SearchVideosParams{
+		Query:  q,
+		UserID: userID,
+		Limit:  limit + 1,
+		Offset: offset,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+	for i := range results {
+		results[i].Video = cfg.withMediaURLs(r, results[i].Video)
+	}
+
+	type response struct {
+		Results    []database.VideoSearchResult `json:"results"`
+		NextCursor *string                      `json:"next_cursor"`
+	}
+	resp := response{Results: results}
+	if len(results) > limit {
+		resp.Results = results[:limit]
+		cursor := encodeSearchCursor(offset + limit)
+		resp.NextCursor = &cursor
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
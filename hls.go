@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const jobKindPackageHLS = "package_hls"
+
+const hlsAudioBitrateKbps = 128
+
+type hlsRendition struct {
+	Height      int
+	BitrateKbps int
+}
+
+func (r hlsRendition) name() string {
+	return fmt.Sprintf("%dp", r.Height)
+}
+
+var defaultHLSLadder = []hlsRendition{
+	{Height: 1080, BitrateKbps: 5000},
+	{Height: 720, BitrateKbps: 2800},
+	{Height: 480, BitrateKbps: 1400},
+	{Height: 360, BitrateKbps: 800},
+}
+
+// parseHLSLadder reads a ladder like "1080:5000,720:2800,480". Heights
+// without a bitrate use the default for that height, or a rough estimate.
+// "none" disables HLS packaging.
+func parseHLSLadder(raw string) ([]hlsRendition, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return defaultHLSLadder, nil
+	}
+	if raw == "none" {
+		return nil, nil
+	}
+
+	ladder := []hlsRendition{}
+	for _, part := range strings.Split(raw, ",") {
+		heightStr, bitrateStr, hasBitrate := strings.Cut(strings.TrimSpace(part), ":")
+		height, err := strconv.Atoi(strings.TrimSuffix(heightStr, "p"))
+		if err != nil || height <= 0 || height%2 != 0 {
+			return nil, fmt.Errorf("invalid HLS rendition height %q", heightStr)
+		}
+
+		rendition := hlsRendition{Height: height, BitrateKbps: height * 4}
+		for _, d := range defaultHLSLadder {
+			if d.Height == height {
+				rendition.BitrateKbps = d.BitrateKbps
+			}
+		}
+		if hasBitrate {
+			rendition.BitrateKbps, err = strconv.Atoi(bitrateStr)
+			if err != nil || rendition.BitrateKbps <= 0 {
+				return nil, fmt.Errorf("invalid HLS rendition bitrate %q", bitrateStr)
+			}
+		}
+		ladder = append(ladder, rendition)
+	}
+	return ladder, nil
+}
+
+type packageHLSPayload struct {
+	VideoKey string `json:"video_key"`
+}
+
+func (cfg *apiConfig) enqueueHLSPackaging(videoID uuid.UUID, videoKey string) (database.Job, error) {
+	payload, err := json.Marshal(packageHLSPayload{VideoKey: videoKey})
+	if err != nil {
+		return database.Job{}, err
+	}
+	return cfg.enqueueJob(database.CreateJobParams{
+		Kind:    jobKindPackageHLS,
+		VideoID: videoID,
+		Payload: string(payload),
+	})
+}
+
+// hlsPrefix is where the renditions of a published MP4 live, e.g.
+// "landscape/abc.mp4" -> "landscape/abc/hls".
+func hlsPrefix(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/hls"
+}
+
+func (cfg *apiConfig) packageHLSJob(ctx context.Context, job database.Job) error {
+	var payload packageHLSPayload
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return permanent(err)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-hls.mp4")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	source, err := cfg.videoStore.Get(ctx, payload.VideoKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Replaced or deleted before we got to it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, source)
+	source.Close()
+	if err != nil {
+		return err
+	}
+
+	outputDir, err := os.MkdirTemp("", "tubely-hls")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	err = cfg.processVideoForHLS(ctx, tempFile.Name(), outputDir)
+	if err != nil {
+		return mediaJobError(fmt.Errorf("couldn't package HLS: %w", err))
+	}
+
+	prefix := hlsPrefix(payload.VideoKey)
+	err = filepath.WalkDir(outputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cfg.videoStore.Put(ctx, prefix+"/"+filepath.ToSlash(rel), f, hlsContentType(p))
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every video sharing the MP4 gets the renditions.
+	masterKey := prefix + "/master.m3u8"
+	n, err := cfg.db.SetHLSKey(payload.VideoKey, masterKey)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Every video using the MP4 was deleted or re-uploaded while we
+		// were packaging, so nothing will refer to these renditions.
+		return cfg.scheduleDeletions(database.CreatePendingDeletionParams{Store: deletionStoreVideo, Key: prefix + "/"})
+	}
+	return nil
+}
+
+func hlsContentType(filePath string) string {
+	switch filepath.Ext(filePath) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// processVideoForHLS transcodes every rendition of the ladder that isn't
+// taller than the source into outputDir/<height>p/ and writes a master
+// playlist pointing at them to outputDir/master.m3u8.
+func (cfg *apiConfig) processVideoForHLS(ctx context.Context, filePath, outputDir string) error {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	source, ok := probe.videoStream()
+	if !ok {
+		return errNoVideoStream
+	}
+	if source.Width == 0 || source.Height == 0 {
+		return fmt.Errorf("%w: %dx%d", errInvalidDimensions, source.Width, source.Height)
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	renditions := renditionsForSource(cfg.hlsLadder, source.Height)
+	if len(renditions) == 0 {
+		return errors.New("HLS ladder is empty")
+	}
+
+	for _, rendition := range renditions {
+		renditionDir := filepath.Join(outputDir, rendition.name())
+		err := os.MkdirAll(renditionDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = cfg.transcoder.TranscodeHLS(ctx, filePath, renditionDir, rendition)
+		if err != nil {
+			return fmt.Errorf("rendition %s: %w", rendition.name(), err)
+		}
+
+		width := source.Width * rendition.Height / source.Height
+		width += width % 2
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/index.m3u8\n",
+			(rendition.BitrateKbps+hlsAudioBitrateKbps)*1000, width, rendition.Height, rendition.name())
+	}
+
+	return os.WriteFile(filepath.Join(outputDir, "master.m3u8"), []byte(master.String()), 0644)
+}
+
+// renditionsForSource drops renditions that would upscale the source. If the
+// source is smaller than every rendition, the smallest one is kept so there
+// is always something to play.
+func renditionsForSource(ladder []hlsRendition, sourceHeight int) []hlsRendition {
+	renditions := []hlsRendition{}
+	var smallest *hlsRendition
+	for i, rendition := range ladder {
+		if smallest == nil || rendition.Height < smallest.Height {
+			smallest = &ladder[i]
+		}
+		if rendition.Height <= sourceHeight {
+			renditions = append(renditions, rendition)
+		}
+	}
+	if len(renditions) == 0 && smallest != nil {
+		renditions = append(renditions, *smallest)
+	}
+	return renditions
+}
@@ -0,0 +1,212 @@
+// Package cloudfront creates CloudFront signed URLs and signed cookies for
+// private content, as described in
+// https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/PrivateContent.html
+package cloudfront
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy says what a signature grants access to. Only Resource and Expires
+// are required. A signed URL whose policy has nothing else set and covers
+// just that URL uses a canned policy, which makes for shorter URLs.
+type Policy struct {
+	// Resource is the URL the signature is good for. It may contain * and ?
+	// wildcards, e.g. https://d111111abcdef8.cloudfront.net/videos/abc/*
+	Resource string
+	Expires  time.Time
+	// NotBefore, if set, is when the signature starts working.
+	NotBefore time.Time
+	// IPRange, if set, limits use to clients in this CIDR range.
+	IPRange string
+}
+
+func (p Policy) canned() bool {
+	return p.NotBefore.IsZero() && p.IPRange == ""
+}
+
+type epochTime struct {
+	EpochTime int64 `json:"AWS:EpochTime"`
+}
+
+type sourceIP struct {
+	SourceIP string `json:"AWS:SourceIp"`
+}
+
+// CloudFront rebuilds canned policies from the URL and checks the signature
+// against its own copy, so the JSON must come out exactly like AWS's: no
+// whitespace and fields in this order.
+type policyCondition struct {
+	DateLessThan    epochTime  `json:"DateLessThan"`
+	IPAddress       *sourceIP  `json:"IpAddress,omitempty"`
+	DateGreaterThan *epochTime `json:"DateGreaterThan,omitempty"`
+}
+
+type policyStatement struct {
+	Resource  string          `json:"Resource"`
+	Condition policyCondition `json:"Condition"`
+}
+
+type policyDocument struct {
+	Statement []policyStatement `json:"Statement"`
+}
+
+// JSON returns the policy document CloudFront expects.
+func (p Policy) JSON() ([]byte, error) {
+	if p.Resource == "" {
+		return nil, errors.New("policy has no resource")
+	}
+	if p.Expires.IsZero() {
+		return nil, errors.New("policy has no expiry")
+	}
+
+	statement := policyStatement{
+		Resource: p.Resource,
+		Condition: policyCondition{
+			DateLessThan: epochTime{p.Expires.Unix()},
+		},
+	}
+	if p.IPRange != "" {
+		statement.Condition.IPAddress = &sourceIP{p.IPRange}
+	}
+	if !p.NotBefore.IsZero() {
+		statement.Condition.DateGreaterThan = &epochTime{p.NotBefore.Unix()}
+	}
+
+	// CloudFront compares URLs byte for byte, so & and friends must not be
+	// escaped the way encoding/json does by default.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(policyDocument{Statement: []policyStatement{statement}})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// Signer signs with the private key of a CloudFront key pair or public key.
+type Signer struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+func NewSigner(keyPairID string, key *rsa.PrivateKey) *Signer {
+	return &Signer{keyPairID: keyPairID, key: key}
+}
+
+// ParsePrivateKey reads an RSA private key in PKCS #1 or PKCS #8 PEM form,
+// as CloudFront key pairs are downloaded.
+func ParsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// SignURL returns rawURL with the query parameters that let CloudFront serve
+// it under the policy. An empty policy resource defaults to rawURL.
+func (s *Signer) SignURL(rawURL string, policy Policy) (string, error) {
+	if policy.Resource == "" {
+		policy.Resource = rawURL
+	}
+	// CloudFront rebuilds canned policies from the URL itself, so they only
+	// work when the resource is exactly that URL.
+	query, err := s.signedQuery(policy, policy.canned() && policy.Resource == rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + query.Encode(), nil
+}
+
+// SignedQuery returns the Expires or Policy, Signature and Key-Pair-Id query
+// parameters for the policy. With a wildcard resource they can be added to
+// every URL the resource matches, such as the segments of an HLS stream.
+func (s *Signer) SignedQuery(policy Policy) (url.Values, error) {
+	return s.signedQuery(policy, false)
+}
+
+func (s *Signer) signedQuery(policy Policy, canned bool) (url.Values, error) {
+	doc, signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if canned {
+		query.Set("Expires", strconv.FormatInt(policy.Expires.Unix(), 10))
+	} else {
+		query.Set("Policy", encode(doc))
+	}
+	query.Set("Signature", signature)
+	query.Set("Key-Pair-Id", s.keyPairID)
+	return query, nil
+}
+
+// Cookies returns the signed cookies for the policy. They always carry the
+// full policy, so a wildcard resource covers everything a player fetches
+// from the distribution.
+func (s *Signer) Cookies(policy Policy) ([]*http.Cookie, error) {
+	doc, signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	return []*http.Cookie{
+		{Name: "CloudFront-Policy", Value: encode(doc)},
+		{Name: "CloudFront-Signature", Value: signature},
+		{Name: "CloudFront-Key-Pair-Id", Value: s.keyPairID},
+	}, nil
+}
+
+func (s *Signer) sign(policy Policy) ([]byte, string, error) {
+	doc, err := policy.JSON()
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha1.Sum(doc)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return nil, "", err
+	}
+	return doc, encode(sig), nil
+}
+
+// CloudFront uses base64 with the characters that are special in URLs
+// swapped out.
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+func encode(data []byte) string {
+	return cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(data))
+}
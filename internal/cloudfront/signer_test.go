@@ -0,0 +1,304 @@
+package cloudfront
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testKeyPairID = "K2JCJMDEHXQW5F"
+
+var testKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+var (
+	expires   = time.Unix(1357034400, 0)
+	notBefore = time.Unix(1357030800, 0)
+)
+
+// urlSafe matches what may appear in a policy or signature parameter.
+var urlSafe = regexp.MustCompile(`^[A-Za-z0-9~_-]+$`)
+
+// decode reverses CloudFront's base64 variant.
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return data
+}
+
+// verify checks a signature parameter against the policy document the way
+// CloudFront does, with the public key.
+func verify(t *testing.T, doc, signature string) {
+	t.Helper()
+	if !urlSafe.MatchString(signature) {
+		t.Errorf("signature %q isn't URL safe", signature)
+	}
+	hash := sha1.Sum([]byte(doc))
+	err := rsa.VerifyPKCS1v15(&testKey().PublicKey, crypto.SHA1, hash[:], decode(t, signature))
+	if err != nil {
+		t.Errorf("signature doesn't verify against %s: %v", doc, err)
+	}
+}
+
+func TestPolicyJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "canned",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/a.mp4", Expires: expires},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/a.mp4","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+		{
+			name:   "query string isn't escaped",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/a.mp4?size=large&t=<1>", Expires: expires},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/a.mp4?size=large&t=<1>","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+		{
+			name: "custom",
+			policy: Policy{
+				Resource:  "https://d111111abcdef8.cloudfront.net/videos/abc/*",
+				Expires:   expires,
+				NotBefore: notBefore,
+				IPRange:   "192.0.2.0/24",
+			},
+			want: `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/abc/*","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400},"IpAddress":{"AWS:SourceIp":"192.0.2.0/24"},"DateGreaterThan":{"AWS:EpochTime":1357030800}}}]}`,
+		},
+		{
+			name:   "not before only",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/*", Expires: expires, NotBefore: notBefore},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/*","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400},"DateGreaterThan":{"AWS:EpochTime":1357030800}}}]}`,
+		},
+		{name: "no resource", policy: Policy{Expires: expires}, wantErr: true},
+		{name: "no expiry", policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/a.mp4"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.JSON()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignURLCanned(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawURL  string
+		wantSep string
+	}{
+		{name: "plain", rawURL: "https://d111111abcdef8.cloudfront.net/videos/a.mp4", wantSep: "?"},
+		{name: "with query", rawURL: "https://d111111abcdef8.cloudfront.net/videos/a.mp4?download=1", wantSep: "&"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := NewSigner(testKeyPairID, testKey())
+			signed, err := signer.SignURL(tt.rawURL, Policy{Expires: expires})
+			if err != nil {
+				t.Fatalf("SignURL: %v", err)
+			}
+			if !strings.HasPrefix(signed, tt.rawURL+tt.wantSep) {
+				t.Fatalf("got %s, want the URL followed by %q", signed, tt.wantSep)
+			}
+
+			query := signedParams(t, signed)
+			if got := query.Get("Expires"); got != "1357034400" {
+				t.Errorf("got Expires %q, want 1357034400", got)
+			}
+			if query.Has("Policy") {
+				t.Error("canned policy URL has a Policy parameter")
+			}
+			if got := query.Get("Key-Pair-Id"); got != testKeyPairID {
+				t.Errorf("got Key-Pair-Id %q, want %q", got, testKeyPairID)
+			}
+			// CloudFront rebuilds this from the URL it was asked for.
+			canned := `{"Statement":[{"Resource":"` + tt.rawURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`
+			verify(t, canned, query.Get("Signature"))
+		})
+	}
+}
+
+func TestSignURLCustom(t *testing.T) {
+	const rawURL = "https://d111111abcdef8.cloudfront.net/videos/abc/index.m3u8"
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{
+			name:   "ip range",
+			policy: Policy{Expires: expires, IPRange: "192.0.2.0/24"},
+			want:   `{"Statement":[{"Resource":"` + rawURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400},"IpAddress":{"AWS:SourceIp":"192.0.2.0/24"}}}]}`,
+		},
+		{
+			// A canned policy could only cover the URL itself.
+			name:   "wildcard resource",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/abc/*", Expires: expires},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/abc/*","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := NewSigner(testKeyPairID, testKey())
+			signed, err := signer.SignURL(rawURL, tt.policy)
+			if err != nil {
+				t.Fatalf("SignURL: %v", err)
+			}
+
+			query := signedParams(t, signed)
+			if query.Has("Expires") {
+				t.Error("custom policy URL has an Expires parameter")
+			}
+			policy := query.Get("Policy")
+			if !urlSafe.MatchString(policy) {
+				t.Errorf("policy %q isn't URL safe", policy)
+			}
+			if got := string(decode(t, policy)); got != tt.want {
+				t.Errorf("got policy  %s\nwant %s", got, tt.want)
+			}
+			verify(t, tt.want, query.Get("Signature"))
+		})
+	}
+}
+
+func TestSignedQuery(t *testing.T) {
+	signer := NewSigner(testKeyPairID, testKey())
+	policy := Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/abc/*", Expires: expires}
+	query, err := signer.SignedQuery(policy)
+	if err != nil {
+		t.Fatalf("SignedQuery: %v", err)
+	}
+
+	want, _ := policy.JSON()
+	if got := decode(t, query.Get("Policy")); string(got) != string(want) {
+		t.Errorf("got policy %s, want %s", got, want)
+	}
+	if query.Has("Expires") {
+		t.Error("signed query has an Expires parameter")
+	}
+	verify(t, string(want), query.Get("Signature"))
+}
+
+func TestCookies(t *testing.T) {
+	signer := NewSigner(testKeyPairID, testKey())
+	policy := Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/abc/*", Expires: expires, NotBefore: notBefore}
+	cookies, err := signer.Cookies(policy)
+	if err != nil {
+		t.Fatalf("Cookies: %v", err)
+	}
+
+	values := map[string]string{}
+	for _, cookie := range cookies {
+		values[cookie.Name] = cookie.Value
+	}
+	if len(values) != 3 {
+		t.Fatalf("got cookies %v, want Policy, Signature and Key-Pair-Id", values)
+	}
+	want, _ := policy.JSON()
+	if got := decode(t, values["CloudFront-Policy"]); string(got) != string(want) {
+		t.Errorf("got policy %s, want %s", got, want)
+	}
+	if values["CloudFront-Key-Pair-Id"] != testKeyPairID {
+		t.Errorf("got key pair ID %q, want %q", values["CloudFront-Key-Pair-Id"], testKeyPairID)
+	}
+	verify(t, string(want), values["CloudFront-Signature"])
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{data: []byte{0xfb, 0xff, 0xfe}, want: "-~~-"}, // +//+
+		{data: []byte{0xff}, want: "~w__"},             // /w==
+		{data: []byte{0xfb, 0xef}, want: "--8_"},       // ++8=
+		{data: []byte("cloudfront"), want: "Y2xvdWRmcm9udA__"},
+	}
+	for _, tt := range tests {
+		if got := encode(tt.data); got != tt.want {
+			t.Errorf("encode(% x) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(testKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr bool
+	}{
+		{name: "pkcs1", pem: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey())})},
+		{name: "pkcs8", pem: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+		{name: "ec key", pem: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}), wantErr: true},
+		{name: "garbage", pem: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("nope")}), wantErr: true},
+		{name: "not pem", pem: []byte("-----BEGIN nothing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePrivateKey(tt.pem)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && !key.Equal(testKey()) {
+				t.Error("parsed a different key")
+			}
+		})
+	}
+}
+
+// signedParams returns the query parameters SignURL added.
+func signedParams(t *testing.T, signed string) url.Values {
+	t.Helper()
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parsing signed URL: %v", err)
+	}
+	query := u.Query()
+	// URL safe values go in the query as they are, without escaping.
+	for _, name := range []string{"Policy", "Signature"} {
+		if value := query.Get(name); value != "" && !strings.Contains(u.RawQuery, name+"="+value) {
+			t.Errorf("%s was escaped in %q", name, u.RawQuery)
+		}
+	}
+	return query
+}
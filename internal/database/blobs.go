@@ -0,0 +1,247 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Blob is a published video file stored under a key derived from the
+// SHA-256 of the upload it was made from. Videos uploaded from the same file
+// share the blob, which is only deleted once none of them use it.
+type Blob struct {
+	Hash      string    `json:"hash"`
+	Key       string    `json:"key"`
+	RefCount  int       `json:"ref_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlobFiles lists the stored files that make up the blob at key, to be
+// queued for deletion once its last reference is gone.
+type BlobFiles func(key string) []CreatePendingDeletionParams
+
+// GetBlob returns the blob made from an upload with the given hash, or a
+// zero Blob if there is none.
+func (c Client) GetBlob(hash string) (Blob, error) {
+	query := `SELECT hash, object_key, ref_count, created_at FROM blobs WHERE hash = ?`
+	var blob Blob
+	err := c.queryRow(query, hash).Scan(&blob.Hash, &blob.Key, &blob.RefCount, &blob.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, nil
+	}
+	return blob, err
+}
+
+// GetVideoByKey returns a video published as the given key, or a zero Video
+// if there is none.
+func (c Client) GetVideoByKey(key string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_key = ?
+	LIMIT 1
+	`
+	video, err := scanVideo(c.queryRow(query, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Video{}, nil
+	}
+	return video, err
+}
+
+var (
+	ErrBlobExists   = errors.New("a blob was already made from this upload")
+	ErrBlobNotFound = errors.New("blob not found")
+)
+
+// CreateVideoBlob records a newly stored blob made from the upload with the
+// given hash and publishes the video as it. It returns ErrBlobExists if
+// someone else got there first.
+func (c Client) CreateVideoBlob(video Video, hash string, blobFiles BlobFiles) error {
+	return c.setVideoBlob(video, blobFiles, func(tx *sql.Tx) error {
+		query := `
+		INSERT INTO blobs (hash, object_key, ref_count, created_at)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (hash) DO NOTHING
+		`
+		result, err := tx.Exec(c.dialect.rebind(query), hash, *video.VideoKey, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrBlobExists
+		}
+		return nil
+	})
+}
+
+// ReuseVideoBlob publishes the video as an existing blob made from the
+// upload with the given hash. It returns ErrBlobNotFound if the blob's last
+// reference went away in the meantime.
+func (c Client) ReuseVideoBlob(video Video, hash string, blobFiles BlobFiles) error {
+	return c.setVideoBlob(video, blobFiles, func(tx *sql.Tx) error {
+		query := `
+		UPDATE blobs
+		SET ref_count = ref_count + 1
+		WHERE hash = ? AND object_key = ?
+		`
+		result, err := tx.Exec(c.dialect.rebind(query), hash, *video.VideoKey)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrBlobNotFound
+		}
+		return nil
+	})
+}
+
+// setVideoBlob saves the video's keys and what processing learned about
+// its file, taking a reference to its new blob with acquire and dropping
+// the one to the blob it used before. Everything else the video may have
+// been edited to in the meantime is left alone; the thumbnail key is only
+// saved if the video still has no thumbnail. It returns ErrVideoNotFound if
+// the video was deleted.
+func (c Client) setVideoBlob(video Video, blobFiles BlobFiles, acquire func(tx *sql.Tx) error) error {
+	if video.VideoKey == nil {
+		return errors.New("video has no key")
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, err := c.lockVideoKey(tx, video.ID)
+	if err != nil {
+		return err
+	}
+	// Take the new reference first so re-uploading the same file never
+	// lets the count drop to zero.
+	err = acquire(tx)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE videos
+	SET
+		updated_at = ?,
+		video_key = ?,
+		hls_key = ?,
+		duration = ?,
+		width = ?,
+		height = ?,
+		frame_rate = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		bit_rate = ?,
+		file_size = ?,
+		rotation = ?,
+		orientation = ?,
+		thumbnail_key = CASE
+			WHEN thumbnail_key IS NULL AND thumbnail_url IS NULL THEN ?
+			ELSE thumbnail_key
+		END
+	WHERE id = ?
+	`
+	_, err = tx.Exec(
+		c.dialect.rebind(query),
+		time.Now().UTC().Truncate(time.Microsecond),
+		video.VideoKey,
+		video.HLSKey,
+		video.Duration,
+		video.Width,
+		video.Height,
+		video.FrameRate,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.BitRate,
+		video.FileSize,
+		video.Rotation,
+		video.Orientation,
+		video.ThumbnailKey,
+		video.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if oldKey != nil {
+		err = c.releaseBlob(tx, *oldKey, blobFiles)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetHLSKey points every video published as videoKey at its HLS stream and
+// returns how many there were.
+func (c Client) SetHLSKey(videoKey, hlsKey string) (int64, error) {
+	query := `
+	UPDATE videos
+	SET hls_key = ?, updated_at = ?
+	WHERE video_key = ?
+	`
+	result, err := c.exec(query, hlsKey, time.Now().UTC().Truncate(time.Microsecond), videoKey)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// lockVideoKey returns the video's current key, locking its row until the
+// transaction ends on Postgres.
+func (c Client) lockVideoKey(tx *sql.Tx, id uuid.UUID) (*string, error) {
+	query := `SELECT video_key FROM videos WHERE id = ?`
+	if c.dialect == dialectPostgres {
+		query += ` FOR UPDATE`
+	}
+	var key *string
+	err := tx.QueryRow(c.dialect.rebind(query), id).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrVideoNotFound
+	}
+	return key, err
+}
+
+// releaseBlob drops a reference to the blob at key and queues its files for
+// deletion if that was the last one. Keys without a blob predate
+// deduplication and belong to a single video.
+func (c Client) releaseBlob(tx *sql.Tx, key string, blobFiles BlobFiles) error {
+	result, err := tx.Exec(c.dialect.rebind(`UPDATE blobs SET ref_count = ref_count - 1 WHERE object_key = ?`), key)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		var refCount int
+		err = tx.QueryRow(c.dialect.rebind(`SELECT ref_count FROM blobs WHERE object_key = ?`), key).Scan(&refCount)
+		if err != nil {
+			return err
+		}
+		if refCount > 0 {
+			return nil
+		}
+		_, err = tx.Exec(c.dialect.rebind(`DELETE FROM blobs WHERE object_key = ?`), key)
+		if err != nil {
+			return err
+		}
+	}
+	return c.createPendingDeletions(tx, blobFiles(key))
+}
@@ -3,87 +3,150 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/lib/pq"
+)
+
+type dialect string
+
+const (
+	dialectSQLite   dialect = "sqlite3"
+	dialectPostgres dialect = "postgres"
 )
 
 type Client struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
 }
 
+// NewClient opens the database and applies any pending migrations.
 func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+	c, err := Open(pathToDB)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
-	err = c.autoMigrate()
+	err = c.Migrate()
 	if err != nil {
 		return Client{}, err
 	}
 	return c, nil
-
 }
 
-func (c *Client) autoMigrate() error {
-	userTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
-	);
-	`
-	_, err := c.db.Exec(userTable)
-	if err != nil {
-		return err
-	}
-	refreshTokenTable := `
-	CREATE TABLE IF NOT EXISTS refresh_tokens (
-		token TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		user_id TEXT NOT NULL,
-		expires_at TIMESTAMP NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(refreshTokenTable)
-	if err != nil {
-		return err
-	}
-
-	videoTable := `
-	CREATE TABLE IF NOT EXISTS videos (
-		id TEXT PRIMARY KEY,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		title TEXT NOT NULL,
-		description TEXT,
-		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	);
-	`
-	_, err = c.db.Exec(videoTable)
+// Open connects to the database without touching the schema. Use it for
+// tools that manage migrations themselves. postgres:// and postgresql://
+// URLs connect to Postgres, anything else is a SQLite file path.
+func Open(pathToDB string) (Client, error) {
+	if isPostgresURL(pathToDB) {
+		db, err := sql.Open("postgres", postgresDSN(pathToDB))
+		if err != nil {
+			return Client{}, err
+		}
+		return Client{db: db, dialect: dialectPostgres}, nil
+	}
+
+	db, err := sql.Open(sqliteDriverName, sqliteDSN(pathToDB))
 	if err != nil {
-		return err
+		return Client{}, err
 	}
-	return nil
+	return Client{db: db, dialect: dialectSQLite}, nil
+}
+
+func isPostgresURL(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// sqliteDSN makes writers wait for each other instead of failing with
+// "database is locked" now that background workers share the database with
+// request handlers.
+func sqliteDSN(pathToDB string) string {
+	if strings.Contains(pathToDB, "_busy_timeout") {
+		return pathToDB
+	}
+	return appendParam(pathToDB, "_busy_timeout=5000&_txlock=immediate")
+}
+
+// postgresDSN pins the session time zone so CURRENT_TIMESTAMP matches the UTC
+// times we write from Go.
+func postgresDSN(dsn string) string {
+	if strings.Contains(dsn, "timezone=") {
+		return dsn
+	}
+	return appendParam(dsn, "timezone=UTC")
+}
+
+func appendParam(dsn, param string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + param
+	}
+	return dsn + "?" + param
+}
+
+// rebind rewrites the ? placeholders used throughout this package into the
+// $1, $2, ... form Postgres expects.
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (c Client) exec(query string, args ...any) (sql.Result, error) {
+	return c.db.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c Client) query(query string, args ...any) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.rebind(query), args...)
+}
+
+func (c Client) queryRow(query string, args ...any) *sql.Row {
+	return c.db.QueryRow(c.dialect.rebind(query), args...)
 }
 
 func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
-		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	// Children first so Postgres doesn't trip over foreign keys.
+	if _, err := c.exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.exec("DELETE FROM upload_parts"); err != nil {
+		return fmt.Errorf("failed to reset table upload_parts: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to reset table uploads: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM pending_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table pending_deletions: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if err := c.resetVideoSearch(); err != nil {
+		return fmt.Errorf("failed to reset video search: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.exec("DELETE FROM refresh_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	}
+	if _, err := c.exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
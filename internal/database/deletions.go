@@ -0,0 +1,137 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PendingDeletion is a stored file that nothing refers to anymore and that
+// still has to be removed from its store.
+type PendingDeletion struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Attempts  int       `json:"attempts"`
+	RunAt     time.Time `json:"run_at"`
+	LastError *string   `json:"last_error"`
+	CreatePendingDeletionParams
+}
+
+type CreatePendingDeletionParams struct {
+	// Store names the blob store the file is in.
+	Store string `json:"store"`
+	// Key is the file's key, or a prefix ending in "/" to delete everything
+	// under it.
+	Key string `json:"key"`
+}
+
+const pendingDeletionColumns = `
+		id,
+		created_at,
+		store,
+		object_key,
+		attempts,
+		run_at,
+		last_error
+`
+
+func scanPendingDeletion(row interface{ Scan(...any) error }) (PendingDeletion, error) {
+	var deletion PendingDeletion
+	err := row.Scan(
+		&deletion.ID,
+		&deletion.CreatedAt,
+		&deletion.Store,
+		&deletion.Key,
+		&deletion.Attempts,
+		&deletion.RunAt,
+		&deletion.LastError,
+	)
+	return deletion, err
+}
+
+func (c Client) CreatePendingDeletions(files []CreatePendingDeletionParams) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = c.createPendingDeletions(tx, files)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c Client) createPendingDeletions(ex execer, files []CreatePendingDeletionParams) error {
+	query := `
+	INSERT INTO pending_deletions (
+		id,
+		created_at,
+		store,
+		object_key,
+		attempts,
+		run_at
+	) VALUES (?, ?, ?, ?, 0, ?)
+	`
+	now := time.Now().UTC()
+	for _, file := range files {
+		_, err := ex.Exec(c.dialect.rebind(query), uuid.New(), now, file.Store, file.Key, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DuePendingDeletions returns up to limit deletions that are due to be
+// tried, oldest first.
+func (c Client) DuePendingDeletions(now time.Time, limit int) ([]PendingDeletion, error) {
+	query := `SELECT` + pendingDeletionColumns + `FROM pending_deletions
+	WHERE run_at <= ?
+	ORDER BY run_at
+	LIMIT ?
+	`
+	return c.queryPendingDeletions(query, now.UTC(), limit)
+}
+
+// ListPendingDeletions returns every deletion that hasn't succeeded yet.
+func (c Client) ListPendingDeletions() ([]PendingDeletion, error) {
+	query := `SELECT` + pendingDeletionColumns + `FROM pending_deletions ORDER BY run_at`
+	return c.queryPendingDeletions(query)
+}
+
+func (c Client) queryPendingDeletions(query string, args ...any) ([]PendingDeletion, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []PendingDeletion{}
+	for rows.Next() {
+		deletion, err := scanPendingDeletion(rows)
+		if err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+// CompletePendingDeletion forgets a deletion once the file is gone.
+func (c Client) CompletePendingDeletion(id uuid.UUID) error {
+	_, err := c.exec(`DELETE FROM pending_deletions WHERE id = ?`, id)
+	return err
+}
+
+// RetryPendingDeletion records a failed attempt and when to try again.
+func (c Client) RetryPendingDeletion(id uuid.UUID, runAt time.Time, lastError string) error {
+	query := `
+	UPDATE pending_deletions
+	SET attempts = attempts + 1, run_at = ?, last_error = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, runAt.UTC(), lastError, id)
+	return err
+}
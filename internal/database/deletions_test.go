@@ -0,0 +1,83 @@
+package database
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkPendingDeletions makes sure exactly want is queued for deletion, in
+// any order.
+func checkPendingDeletions(t *testing.T, c Client, want []CreatePendingDeletionParams) {
+	t.Helper()
+	deletions, err := c.ListPendingDeletions()
+	if err != nil {
+		t.Fatalf("ListPendingDeletions: %v", err)
+	}
+	got := []CreatePendingDeletionParams{}
+	for _, deletion := range deletions {
+		got = append(got, deletion.CreatePendingDeletionParams)
+	}
+	compare := func(a, b CreatePendingDeletionParams) int {
+		return cmp.Or(strings.Compare(a.Store, b.Store), strings.Compare(a.Key, b.Key))
+	}
+	slices.SortFunc(got, compare)
+	want = slices.Clone(want)
+	slices.SortFunc(want, compare)
+	if !slices.Equal(got, want) {
+		t.Errorf("got pending deletions %v, want %v", got, want)
+	}
+}
+
+func TestPendingDeletions(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		files := []CreatePendingDeletionParams{
+			{Store: "video", Key: "landscape/a.mp4"},
+			{Store: "video", Key: "landscape/a/hls/"},
+			{Store: "asset", Key: "thumbnails/a.jpg"},
+		}
+		err := c.CreatePendingDeletions(files)
+		if err != nil {
+			t.Fatalf("CreatePendingDeletions: %v", err)
+		}
+		checkPendingDeletions(t, c, files)
+
+		due, err := c.DuePendingDeletions(time.Now(), 2)
+		if err != nil {
+			t.Fatalf("DuePendingDeletions: %v", err)
+		}
+		if len(due) != 2 {
+			t.Fatalf("got %d due deletions, want the limit of 2", len(due))
+		}
+
+		err = c.RetryPendingDeletion(due[0].ID, time.Now().Add(time.Hour), "access denied")
+		if err != nil {
+			t.Fatalf("RetryPendingDeletion: %v", err)
+		}
+		err = c.CompletePendingDeletion(due[1].ID)
+		if err != nil {
+			t.Fatalf("CompletePendingDeletion: %v", err)
+		}
+
+		due, err = c.DuePendingDeletions(time.Now(), 10)
+		if err != nil {
+			t.Fatalf("DuePendingDeletions: %v", err)
+		}
+		if len(due) != 1 {
+			t.Fatalf("got %d due deletions, want the one never tried", len(due))
+		}
+		all, err := c.ListPendingDeletions()
+		if err != nil {
+			t.Fatalf("ListPendingDeletions: %v", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("got %d pending deletions, want 2", len(all))
+		}
+		retried := all[len(all)-1]
+		if retried.Attempts != 1 || retried.LastError == nil || *retried.LastError != "access denied" {
+			t.Errorf("got %+v, want the retried deletion last, after 1 attempt", retried)
+		}
+	})
+}
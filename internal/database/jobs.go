@@ -0,0 +1,332 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+type Job struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Status      JobStatus  `json:"status"`
+	Attempts    int        `json:"attempts"`
+	RunAt       time.Time  `json:"run_at"`
+	LockedUntil *time.Time `json:"-"`
+	LastError   *string    `json:"last_error"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	Kind        string    `json:"kind"`
+	VideoID     uuid.UUID `json:"video_id"`
+	Payload     string    `json:"-"`
+	MaxAttempts int       `json:"max_attempts"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at,
+		locked_until,
+		last_error
+`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Kind,
+		&job.VideoID,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedUntil,
+		&job.LastError,
+	)
+	return job, err
+}
+
+// CreateJob queues a job. If the same job is already waiting or running,
+// that one is returned instead of queueing another.
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?, ?)
+	ON CONFLICT DO NOTHING
+	`
+	// The existing job may finish between the insert and looking it up, in
+	// which case there's room for a new one.
+	for range 3 {
+		id := uuid.New()
+		result, err := c.exec(
+			query,
+			id,
+			params.Kind,
+			params.VideoID,
+			params.Payload,
+			JobStatusPending,
+			params.MaxAttempts,
+			time.Now().UTC(),
+		)
+		if err != nil {
+			return Job{}, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return Job{}, err
+		}
+		if n > 0 {
+			return c.GetJob(id)
+		}
+
+		job, err := c.unfinishedJob(params)
+		if err != nil {
+			return Job{}, err
+		}
+		if job.ID != uuid.Nil {
+			return job, nil
+		}
+	}
+	return Job{}, errors.New("couldn't queue job: an identical job kept getting in the way")
+}
+
+func (c Client) unfinishedJob(params CreateJobParams) (Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs
+	WHERE kind = ? AND video_id = ? AND payload = ? AND status IN (?, ?)
+	`
+	job, err := scanJob(c.queryRow(query, params.Kind, params.VideoID, params.Payload, JobStatusPending, JobStatusRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, nil
+	}
+	return job, err
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs WHERE id = ?`
+	job, err := scanJob(c.queryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// UnfinishedJobs returns the jobs of a kind that are waiting to run or
+// running.
+func (c Client) UnfinishedJobs(kind string) ([]Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs WHERE kind = ? AND status IN (?, ?)`
+	rows, err := c.query(query, kind, JobStatusPending, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimJob marks the next runnable job as running and returns it, or nil if
+// there is nothing to do. Running jobs whose lease has expired are picked up
+// again, which is how work survives a crash or restart, unless they're out
+// of attempts. Those are failed instead, so a file that crashes the worker
+// isn't tried forever. The returned job's Attempts is what the worker then
+// passes to ExtendJobLease and to whichever call records the outcome.
+func (c Client) ClaimJob(lease time.Duration) (*Job, error) {
+	now := time.Now().UTC()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	failQuery := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_until = NULL,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ? AND locked_until < ? AND attempts >= max_attempts
+	`
+	_, err = tx.Exec(
+		c.dialect.rebind(failQuery),
+		JobStatusFailed,
+		"lease expired on the last attempt; the worker may have crashed",
+		JobStatusRunning,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite serializes writers, but concurrent Postgres workers must skip
+	// rows another worker is already claiming.
+	lockClause := ""
+	if c.dialect == dialectPostgres {
+		lockClause = "FOR UPDATE SKIP LOCKED"
+	}
+
+	// The runnable condition is repeated outside the subquery so a worker
+	// that lost a race doesn't claim the same job again.
+	runnable := `((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))
+		AND attempts < max_attempts`
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		locked_until = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE ` + runnable + `
+		ORDER BY run_at
+		LIMIT 1
+		` + lockClause + `
+	)
+	AND ` + runnable + `
+	RETURNING` + jobColumns
+
+	job, err := scanJob(tx.QueryRow(
+		c.dialect.rebind(query),
+		JobStatusRunning,
+		now.Add(lease),
+		JobStatusPending,
+		now,
+		JobStatusRunning,
+		now,
+		JobStatusPending,
+		now,
+		JobStatusRunning,
+		now,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ErrJobLeaseLost means the job was taken over by another worker, or
+// finished, after the caller's lease ran out.
+var ErrJobLeaseLost = errors.New("job lease was lost")
+
+// The attempt number a job was claimed with identifies the worker that
+// holds it, so the functions below only touch a job that is still running
+// under that attempt. A worker whose lease ran out gets ErrJobLeaseLost
+// instead of overwriting the outcome of the one that took over.
+
+// ExtendJobLease keeps a long running job from being claimed by another worker.
+func (c Client) ExtendJobLease(id uuid.UUID, attempt int, lease time.Duration) error {
+	query := `
+	UPDATE jobs
+	SET locked_until = ?
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return checkJobLease(c.exec(query, time.Now().UTC().Add(lease), id, JobStatusRunning, attempt))
+}
+
+func (c Client) CompleteJob(id uuid.UUID, attempt int) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_until = NULL,
+		last_error = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return checkJobLease(c.exec(query, JobStatusSucceeded, id, JobStatusRunning, attempt))
+}
+
+// RetryJob puts a job back in the queue to run again at runAt.
+func (c Client) RetryJob(id uuid.UUID, attempt int, runAt time.Time, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		run_at = ?,
+		locked_until = NULL,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return checkJobLease(c.exec(query, JobStatusPending, runAt.UTC(), lastError, id, JobStatusRunning, attempt))
+}
+
+func (c Client) FailJob(id uuid.UUID, attempt int, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_until = NULL,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ? AND attempts = ?
+	`
+	return checkJobLease(c.exec(query, JobStatusFailed, lastError, id, JobStatusRunning, attempt))
+}
+
+func checkJobLease(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func claim(t *testing.T, c Client, lease time.Duration) *Job {
+	t.Helper()
+	job, err := c.ClaimJob(lease)
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	return job
+}
+
+// setRunAt reschedules a job without claiming it.
+func setRunAt(t *testing.T, c Client, id uuid.UUID, runAt time.Time) {
+	t.Helper()
+	_, err := c.exec(`UPDATE jobs SET run_at = ? WHERE id = ?`, runAt.UTC(), id)
+	if err != nil {
+		t.Fatalf("setting run_at: %v", err)
+	}
+}
+
+func getJob(t *testing.T, c Client, id uuid.UUID) Job {
+	t.Helper()
+	job, err := c.GetJob(id)
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	return job
+}
+
+func TestCreateJob(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		params := CreateJobParams{Kind: "process", VideoID: f.video.ID, Payload: `{"key":"a"}`, MaxAttempts: 3}
+
+		job, err := c.CreateJob(params)
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		if job.ID == uuid.Nil || job.Status != JobStatusPending || job.Attempts != 0 || job.CreateJobParams != params {
+			t.Fatalf("got %+v, want a pending job made from %+v", job, params)
+		}
+
+		// An identical job that hasn't finished is reused, running or not.
+		again, err := c.CreateJob(params)
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		if again.ID != job.ID {
+			t.Errorf("got a second job %s while %s was pending", again.ID, job.ID)
+		}
+		running := claim(t, c, time.Minute)
+		again, err = c.CreateJob(params)
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		if again.ID != job.ID {
+			t.Errorf("got a second job %s while %s was running", again.ID, job.ID)
+		}
+
+		other := params
+		other.Payload = `{"key":"b"}`
+		otherJob, err := c.CreateJob(other)
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		if otherJob.ID == job.ID {
+			t.Error("a job with another payload was merged into the first")
+		}
+
+		err = c.CompleteJob(running.ID, running.Attempts)
+		if err != nil {
+			t.Fatalf("CompleteJob: %v", err)
+		}
+		again, err = c.CreateJob(params)
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		if again.ID == job.ID {
+			t.Error("the finished job was returned instead of a new one")
+		}
+	})
+}
+
+func TestClaimJob(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		if job := claim(t, c, time.Minute); job != nil {
+			t.Fatalf("claimed %s from an empty queue", job.ID)
+		}
+
+		created, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, MaxAttempts: 3})
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		job := claim(t, c, time.Minute)
+		if job == nil || job.ID != created.ID {
+			t.Fatalf("claimed %v, want job %s", job, created.ID)
+		}
+		// The RETURNING clause hands back the row as updated.
+		if job.Status != JobStatusRunning || job.Attempts != 1 {
+			t.Errorf("got status %s after %d attempts, want running after 1", job.Status, job.Attempts)
+		}
+		if job.LockedUntil == nil || !within(*job.LockedUntil, time.Now().Add(time.Minute), 5*time.Second) {
+			t.Errorf("got locked until %v, want a minute from now", job.LockedUntil)
+		}
+		if job.Kind != "process" || job.VideoID != f.video.ID {
+			t.Errorf("got %+v, want the job that was created", job.CreateJobParams)
+		}
+		if job := claim(t, c, time.Minute); job != nil {
+			t.Fatalf("claimed job %s again while its lease holds", job.ID)
+		}
+
+		err = c.RetryJob(job.ID, job.Attempts, time.Now().Add(time.Hour), "try later")
+		if err != nil {
+			t.Fatalf("RetryJob: %v", err)
+		}
+		if job := claim(t, c, time.Minute); job != nil {
+			t.Fatalf("claimed job %s before it was due", job.ID)
+		}
+		setRunAt(t, c, job.ID, time.Now().Add(-time.Second))
+		job = claim(t, c, time.Minute)
+		if job == nil || job.Attempts != 2 || job.LastError == nil || *job.LastError != "try later" {
+			t.Fatalf("got %+v, want the second attempt", job)
+		}
+	})
+}
+
+func TestClaimJobOrder(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		now := time.Now()
+		var ids []uuid.UUID
+		// Queued newest first, so claims must go by run_at.
+		for i := range 3 {
+			job, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, Payload: uuid.NewString(), MaxAttempts: 3})
+			if err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+			setRunAt(t, c, job.ID, now.Add(-time.Duration(i+1)*time.Minute))
+			ids = append(ids, job.ID)
+		}
+
+		for i := len(ids) - 1; i >= 0; i-- {
+			job := claim(t, c, time.Minute)
+			if job == nil || job.ID != ids[i] {
+				t.Fatalf("claimed %v, want job %s", job, ids[i])
+			}
+		}
+	})
+}
+
+func TestClaimJobExpiredLease(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		created, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, MaxAttempts: 2})
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+
+		// A worker that claims the job and dies lets its lease run out.
+		claim(t, c, -time.Second)
+		job := claim(t, c, -time.Second)
+		if job == nil || job.ID != created.ID || job.Attempts != 2 {
+			t.Fatalf("got %+v, want job %s taken over for its second attempt", job, created.ID)
+		}
+
+		// That was the last attempt, so the job fails instead of running
+		// again.
+		if job := claim(t, c, time.Minute); job != nil {
+			t.Fatalf("claimed job %s past its last attempt", job.ID)
+		}
+		failed := getJob(t, c, created.ID)
+		if failed.Status != JobStatusFailed || failed.LastError == nil || failed.LockedUntil != nil {
+			t.Errorf("got %+v, want a failed job with an error and no lease", failed)
+		}
+	})
+}
+
+func TestClaimJobConcurrent(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		const jobs, workers = 20, 5
+		for range jobs {
+			_, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, Payload: uuid.NewString(), MaxAttempts: 3})
+			if err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+		}
+
+		var mu sync.Mutex
+		claimed := map[uuid.UUID]int{}
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					job, err := c.ClaimJob(time.Minute)
+					if err != nil {
+						t.Errorf("ClaimJob: %v", err)
+						return
+					}
+					if job == nil {
+						return
+					}
+					mu.Lock()
+					claimed[job.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(claimed) != jobs {
+			t.Errorf("claimed %d jobs, want %d", len(claimed), jobs)
+		}
+		for id, n := range claimed {
+			if n != 1 {
+				t.Errorf("job %s was claimed %d times", id, n)
+			}
+		}
+	})
+}
+
+func TestFinishJob(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		var jobs []*Job
+		for range 2 {
+			_, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, Payload: uuid.NewString(), MaxAttempts: 3})
+			if err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+			jobs = append(jobs, claim(t, c, time.Minute))
+		}
+
+		err := c.CompleteJob(jobs[0].ID, jobs[0].Attempts)
+		if err != nil {
+			t.Fatalf("CompleteJob: %v", err)
+		}
+		err = c.FailJob(jobs[1].ID, jobs[1].Attempts, "bad file")
+		if err != nil {
+			t.Fatalf("FailJob: %v", err)
+		}
+
+		if job := getJob(t, c, jobs[0].ID); job.Status != JobStatusSucceeded || job.LockedUntil != nil {
+			t.Errorf("got %+v, want a succeeded job with no lease", job)
+		}
+		if job := getJob(t, c, jobs[1].ID); job.Status != JobStatusFailed || job.LastError == nil || *job.LastError != "bad file" {
+			t.Errorf("got %+v, want a job failed with its error", job)
+		}
+		unfinished, err := c.UnfinishedJobs("process")
+		if err != nil {
+			t.Fatalf("UnfinishedJobs: %v", err)
+		}
+		if len(unfinished) != 0 {
+			t.Errorf("got %d unfinished jobs, want none", len(unfinished))
+		}
+	})
+}
+
+func TestStaleWorkerCantFinishJob(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		created, err := c.CreateJob(CreateJobParams{Kind: "process", VideoID: f.video.ID, MaxAttempts: 3})
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+
+		// The first worker stalls past its lease and a second one takes
+		// the job over.
+		stale := claim(t, c, -time.Second)
+		current := claim(t, c, time.Minute)
+		if current == nil || current.ID != created.ID {
+			t.Fatalf("got %+v, want job %s taken over", current, created.ID)
+		}
+
+		if err := c.CompleteJob(stale.ID, stale.Attempts); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("CompleteJob from the stale worker: got %v, want ErrJobLeaseLost", err)
+		}
+		if err := c.FailJob(stale.ID, stale.Attempts, "stale"); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("FailJob from the stale worker: got %v, want ErrJobLeaseLost", err)
+		}
+		if err := c.RetryJob(stale.ID, stale.Attempts, time.Now(), "stale"); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("RetryJob from the stale worker: got %v, want ErrJobLeaseLost", err)
+		}
+		if err := c.ExtendJobLease(stale.ID, stale.Attempts, time.Hour); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("ExtendJobLease from the stale worker: got %v, want ErrJobLeaseLost", err)
+		}
+		job := getJob(t, c, created.ID)
+		if job.Status != JobStatusRunning || job.Attempts != current.Attempts || job.LastError != nil {
+			t.Fatalf("got %+v, want the job still running for the second worker", job)
+		}
+		if job.LockedUntil == nil || !within(*job.LockedUntil, *current.LockedUntil, time.Second) {
+			t.Errorf("got locked until %v, want the second worker's lease %v", job.LockedUntil, current.LockedUntil)
+		}
+
+		err = c.CompleteJob(current.ID, current.Attempts)
+		if err != nil {
+			t.Fatalf("CompleteJob: %v", err)
+		}
+		if job := getJob(t, c, created.ID); job.Status != JobStatusSucceeded {
+			t.Errorf("got %s, want succeeded", job.Status)
+		}
+		// Finished jobs can't be finished again.
+		if err := c.CompleteJob(current.ID, current.Attempts); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("second CompleteJob: got %v, want ErrJobLeaseLost", err)
+		}
+	})
+}
@@ -0,0 +1,792 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	migrationLockTimeout = 2 * time.Minute
+	// A lock older than this was left behind by a process that died
+	// mid-migration.
+	migrationLockStale = 15 * time.Minute
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx migrationTx) error
+	down    func(tx migrationTx) error
+}
+
+// migrationTx is the transaction a migration runs in, along with the dialect
+// it needs to pick the right SQL.
+type migrationTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx migrationTx) exec(query string, args ...any) error {
+	_, err := tx.Exec(tx.dialect.rebind(query), args...)
+	return err
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrations are applied in order and must never be edited once released;
+// add a new one instead. The early ones are written to be no-ops against
+// databases created before migrations existed.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_users",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			password TEXT NOT NULL,
+			email TEXT UNIQUE NOT NULL
+		)`),
+		down: execAll(`DROP TABLE users`),
+	},
+	{
+		version: 2,
+		name:    "create_refresh_tokens",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`),
+		down: execAll(`DROP TABLE refresh_tokens`),
+	},
+	{
+		version: 3,
+		name:    "create_videos",
+		up: perDialect(
+			execAll(`
+			CREATE TABLE IF NOT EXISTS videos (
+				id TEXT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				title TEXT NOT NULL,
+				description TEXT,
+				thumbnail_url TEXT,
+				video_url TEXT TEXT,
+				user_id INTEGER,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			)`),
+			// Postgres rejects the original column types outright, so it
+			// starts with the ones fix_videos_column_types moves SQLite to.
+			execAll(`
+			CREATE TABLE IF NOT EXISTS videos (
+				id TEXT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				title TEXT NOT NULL,
+				description TEXT,
+				thumbnail_url TEXT,
+				video_url TEXT,
+				user_id TEXT,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			)`),
+		),
+		down: execAll(`DROP TABLE videos`),
+	},
+	{
+		version: 4,
+		name:    "create_jobs",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			kind TEXT NOT NULL,
+			video_id TEXT NOT NULL,
+			payload TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL,
+			run_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP,
+			last_error TEXT
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs(status, run_at)`,
+		),
+		down: execAll(`DROP TABLE jobs`),
+	},
+	{
+		version: 5,
+		name:    "add_videos_hls_url",
+		up:      addColumns("videos", column{"hls_url", "TEXT"}),
+		down:    dropColumns("videos", "hls_url"),
+	},
+	{
+		version: 6,
+		name:    "add_videos_media_info",
+		up: addColumns("videos",
+			column{"duration", "REAL"},
+			column{"width", "INTEGER"},
+			column{"height", "INTEGER"},
+			column{"frame_rate", "REAL"},
+			column{"video_codec", "TEXT"},
+			column{"audio_codec", "TEXT"},
+			column{"bit_rate", "INTEGER"},
+			column{"file_size", "INTEGER"},
+			column{"rotation", "INTEGER"},
+		),
+		down: dropColumns("videos",
+			"duration", "width", "height", "frame_rate", "video_codec",
+			"audio_codec", "bit_rate", "file_size", "rotation",
+		),
+	},
+	{
+		// SQLite can't change a column's type in place, so the table is
+		// rebuilt with user_id as TEXT to match users.id.
+		version: 7,
+		name:    "fix_videos_column_types",
+		up:      perDialect(rebuildVideosTable("TEXT", "TEXT"), noop),
+		down:    perDialect(rebuildVideosTable("TEXT TEXT", "INTEGER"), noop),
+	},
+	{
+		// Until now the orientation only lived in the video's storage key,
+		// e.g. https://cdn.example.com/portrait/abc.mp4.
+		version: 8,
+		name:    "add_videos_orientation",
+		up: func(tx migrationTx) error {
+			err := addColumns("videos", column{"orientation", "TEXT"})(tx)
+			if err != nil {
+				return err
+			}
+			for _, orientation := range []string{"landscape", "portrait", "other"} {
+				err := tx.exec(
+					`UPDATE videos SET orientation = ? WHERE orientation IS NULL AND video_url LIKE ?`,
+					orientation,
+					"%/"+orientation+"/%",
+				)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.exec(`CREATE INDEX IF NOT EXISTS idx_videos_user_id_created_at ON videos(user_id, created_at)`)
+		},
+		down: func(tx migrationTx) error {
+			err := tx.exec(`DROP INDEX IF EXISTS idx_videos_user_id_created_at`)
+			if err != nil {
+				return err
+			}
+			return dropColumns("videos", "orientation")(tx)
+		},
+	},
+	{
+		version: 9,
+		name:    "create_videos_search",
+		up:      perDialect(createSQLiteVideoSearch, createPostgresVideoSearch),
+		down: perDialect(
+			execAll(`DROP TABLE IF EXISTS videos_fts`),
+			execAll(`DROP TABLE IF EXISTS videos_search`),
+		),
+	},
+	{
+		version: 10,
+		name:    "add_videos_visibility",
+		// Videos that predate this were readable by anyone with the ID, but
+		// their owners never chose that, so they start out private.
+		up: func(tx migrationTx) error {
+			err := addColumns("videos", column{"visibility", "TEXT NOT NULL DEFAULT 'private'"})(tx)
+			if err != nil {
+				return err
+			}
+			return tx.exec(`CREATE INDEX IF NOT EXISTS idx_videos_visibility_created_at ON videos(visibility, created_at)`)
+		},
+		down: func(tx migrationTx) error {
+			err := tx.exec(`DROP INDEX IF EXISTS idx_videos_visibility_created_at`)
+			if err != nil {
+				return err
+			}
+			return dropColumns("videos", "visibility")(tx)
+		},
+	},
+	{
+		version: 11,
+		name:    "store_video_keys",
+		up: func(tx migrationTx) error {
+			err := execAll(
+				`ALTER TABLE videos RENAME COLUMN video_url TO video_key`,
+				`ALTER TABLE videos RENAME COLUMN hls_url TO hls_key`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+			return rewriteVideoURLsAsKeys(tx)
+		},
+		// The keys stay keys; only the old column names come back.
+		down: execAll(
+			`ALTER TABLE videos RENAME COLUMN video_key TO video_url`,
+			`ALTER TABLE videos RENAME COLUMN hls_key TO hls_url`,
+		),
+	},
+	{
+		version: 12,
+		name:    "create_uploads",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			video_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			metadata TEXT NOT NULL DEFAULT ''
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_uploads_expires_at ON uploads(expires_at)`,
+		),
+		down: execAll(`DROP TABLE uploads`),
+	},
+	{
+		version: 13,
+		name:    "create_pending_deletions",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS pending_deletions (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL,
+			store TEXT NOT NULL,
+			object_key TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			run_at TIMESTAMP NOT NULL,
+			last_error TEXT
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_pending_deletions_run_at ON pending_deletions(run_at)`,
+		),
+		down: execAll(`DROP TABLE pending_deletions`),
+	},
+	{
+		version: 14,
+		name:    "create_blobs",
+		up: execAll(`
+		CREATE TABLE IF NOT EXISTS blobs (
+			hash TEXT PRIMARY KEY,
+			object_key TEXT NOT NULL UNIQUE,
+			ref_count INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_videos_video_key ON videos(video_key)`,
+		),
+		down: execAll(
+			`DROP INDEX IF EXISTS idx_videos_video_key`,
+			`DROP TABLE blobs`,
+		),
+	},
+	{
+		version: 15,
+		name:    "add_videos_thumbnail_key",
+		up:      addColumns("videos", column{"thumbnail_key", "TEXT"}),
+		down:    dropColumns("videos", "thumbnail_key"),
+	},
+	{
+		// Only one of a job may be waiting or running at a time, so asking
+		// twice doesn't process the same upload twice. Duplicates queued
+		// before are failed, keeping the oldest.
+		version: 16,
+		name:    "unique_unfinished_jobs",
+		up: execAll(`
+		UPDATE jobs
+		SET status = 'failed', locked_until = NULL, last_error = 'duplicate of an earlier job'
+		WHERE status IN ('pending', 'running') AND EXISTS (
+			SELECT 1 FROM jobs AS earlier
+			WHERE earlier.kind = jobs.kind
+				AND earlier.video_id = jobs.video_id
+				AND earlier.payload = jobs.payload
+				AND earlier.status IN ('pending', 'running')
+				AND (earlier.created_at < jobs.created_at
+					OR (earlier.created_at = jobs.created_at AND earlier.id < jobs.id))
+		)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_unfinished ON jobs(kind, video_id, payload) WHERE status IN ('pending', 'running')`,
+		),
+		down: execAll(`DROP INDEX IF EXISTS idx_jobs_unfinished`),
+	},
+	{
+		// Uploads are staged in the video store and locked in the database,
+		// so any instance can take the next chunk. Uploads in progress were
+		// staged on one instance's disk, so they start over.
+		version: 17,
+		name:    "stage_uploads_in_storage",
+		up: func(tx migrationTx) error {
+			err := addColumns("uploads",
+				column{"lock_token", "TEXT"},
+				column{"locked_until", "TIMESTAMP"},
+			)(tx)
+			if err != nil {
+				return err
+			}
+			return execAll(`
+			CREATE TABLE IF NOT EXISTS upload_parts (
+				upload_id TEXT NOT NULL,
+				part_offset BIGINT NOT NULL,
+				size BIGINT NOT NULL,
+				object_key TEXT NOT NULL,
+				PRIMARY KEY (upload_id, part_offset)
+			)`,
+				`UPDATE uploads SET upload_offset = 0`,
+			)(tx)
+		},
+		down: func(tx migrationTx) error {
+			err := tx.exec(`DROP TABLE upload_parts`)
+			if err != nil {
+				return err
+			}
+			return dropColumns("uploads", "lock_token", "locked_until")(tx)
+		},
+	},
+}
+
+// rewriteVideoURLsAsKeys strips the scheme, host and any path prefix from
+// URLs stored before videos were tracked by key. Published videos have
+// always lived under a landscape/, portrait/ or other/ prefix, which is how
+// the key is found without knowing the old base URL.
+func rewriteVideoURLsAsKeys(tx migrationTx) error {
+	rows, err := tx.Query(`SELECT id, video_key, hls_key FROM videos WHERE video_key LIKE '%://%' OR hls_key LIKE '%://%'`)
+	if err != nil {
+		return err
+	}
+	type videoKeys struct {
+		id               string
+		videoKey, hlsKey sql.NullString
+	}
+	var videos []videoKeys
+	for rows.Next() {
+		var v videoKeys
+		err := rows.Scan(&v.id, &v.videoKey, &v.hlsKey)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		videos = append(videos, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range videos {
+		err := tx.exec(
+			`UPDATE videos SET video_key = ?, hls_key = ? WHERE id = ?`,
+			keyFromLegacyURL(v.videoKey),
+			keyFromLegacyURL(v.hlsKey),
+			v.id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keyFromLegacyURL(value sql.NullString) sql.NullString {
+	if !value.Valid || !strings.Contains(value.String, "://") {
+		return value
+	}
+	u, err := url.Parse(value.String)
+	if err != nil {
+		return value
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	for _, prefix := range []string{"landscape/", "portrait/", "other/"} {
+		if i := strings.Index("/"+key, "/"+prefix); i >= 0 {
+			return sql.NullString{String: key[i:], Valid: true}
+		}
+	}
+	return sql.NullString{String: key, Valid: true}
+}
+
+func createSQLiteVideoSearch(tx migrationTx) error {
+	err := tx.exec(`CREATE VIRTUAL TABLE videos_fts USING fts5(video_id UNINDEXED, title, description)`)
+	if err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return err
+		}
+		// Built without the sqlite_fts5 tag.
+		err = tx.exec(`CREATE VIRTUAL TABLE videos_fts USING fts4(video_id, title, description, notindexed=video_id)`)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.exec(`
+	INSERT INTO videos_fts (video_id, title, description)
+	SELECT id, title, COALESCE(description, '') FROM videos
+	`)
+}
+
+func createPostgresVideoSearch(tx migrationTx) error {
+	return execAll(
+		`CREATE TABLE IF NOT EXISTS videos_search (
+			video_id TEXT PRIMARY KEY REFERENCES videos(id) ON DELETE CASCADE,
+			document TSVECTOR NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_videos_search_document ON videos_search USING GIN (document)`,
+		`INSERT INTO videos_search (video_id, document)
+		SELECT id, setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', COALESCE(description, '')), 'B')
+		FROM videos
+		ON CONFLICT (video_id) DO NOTHING`,
+	)(tx)
+}
+
+func rebuildVideosTable(videoURLType, userIDType string) func(tx migrationTx) error {
+	return execAll(
+		fmt.Sprintf(`
+		CREATE TABLE videos_new (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			title TEXT NOT NULL,
+			description TEXT,
+			thumbnail_url TEXT,
+			video_url %s,
+			user_id %s,
+			hls_url TEXT,
+			duration REAL,
+			width INTEGER,
+			height INTEGER,
+			frame_rate REAL,
+			video_codec TEXT,
+			audio_codec TEXT,
+			bit_rate INTEGER,
+			file_size INTEGER,
+			rotation INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`, videoURLType, userIDType),
+		`INSERT INTO videos_new (
+			id, created_at, updated_at, title, description, thumbnail_url,
+			video_url, user_id, hls_url, duration, width, height, frame_rate,
+			video_codec, audio_codec, bit_rate, file_size, rotation
+		)
+		SELECT
+			id, created_at, updated_at, title, description, thumbnail_url,
+			video_url, user_id, hls_url, duration, width, height, frame_rate,
+			video_codec, audio_codec, bit_rate, file_size, rotation
+		FROM videos`,
+		`DROP TABLE videos`,
+		`ALTER TABLE videos_new RENAME TO videos`,
+		`CREATE INDEX IF NOT EXISTS idx_videos_user_id ON videos(user_id)`,
+	)
+}
+
+func execAll(statements ...string) func(tx migrationTx) error {
+	return func(tx migrationTx) error {
+		for _, stmt := range statements {
+			if err := tx.exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func perDialect(sqlite, postgres func(tx migrationTx) error) func(tx migrationTx) error {
+	return func(tx migrationTx) error {
+		if tx.dialect == dialectPostgres {
+			return postgres(tx)
+		}
+		return sqlite(tx)
+	}
+}
+
+func noop(tx migrationTx) error {
+	return nil
+}
+
+type column struct {
+	name string
+	// definition uses SQLite types; columnType translates them for Postgres.
+	definition string
+}
+
+func (d dialect) columnType(definition string) string {
+	if d != dialectPostgres {
+		return definition
+	}
+	switch definition {
+	case "REAL":
+		return "DOUBLE PRECISION"
+	case "INTEGER":
+		return "BIGINT"
+	default:
+		return definition
+	}
+}
+
+// addColumns skips columns that already exist, which happens on databases
+// that were created before versioned migrations.
+func addColumns(table string, columns ...column) func(tx migrationTx) error {
+	return func(tx migrationTx) error {
+		if tx.dialect == dialectPostgres {
+			for _, col := range columns {
+				err := tx.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, col.name, tx.dialect.columnType(col.definition)))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		existing, err := sqliteTableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, col := range columns {
+			if existing[col.name] {
+				continue
+			}
+			err := tx.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col.name, col.definition))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func dropColumns(table string, columns ...string) func(tx migrationTx) error {
+	return func(tx migrationTx) error {
+		for _, name := range columns {
+			err := tx.exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func sqliteTableColumns(tx migrationTx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func (c Client) ensureMigrationTables() error {
+	_, err := c.exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = c.exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		owner TEXT NOT NULL,
+		locked_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+// lockMigrations makes sure only one process migrates at a time. The lock is
+// a single row, so it works the same no matter how the processes connect.
+func (c Client) lockMigrations() (release func(), err error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), uuid.NewString())
+	deadline := time.Now().Add(migrationLockTimeout)
+
+	for {
+		_, err := c.exec(
+			`INSERT INTO schema_migrations_lock (id, owner, locked_at) VALUES (1, ?, ?)`,
+			owner,
+			time.Now().UTC(),
+		)
+		if err == nil {
+			break
+		}
+
+		var lockedAt time.Time
+		var holder string
+		row := c.queryRow(`SELECT owner, locked_at FROM schema_migrations_lock WHERE id = 1`)
+		if scanErr := row.Scan(&holder, &lockedAt); scanErr != nil {
+			if errors.Is(scanErr, sql.ErrNoRows) {
+				// Released between our insert and select.
+				continue
+			}
+			return nil, scanErr
+		}
+		if time.Since(lockedAt) > migrationLockStale {
+			_, err = c.exec(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`, holder)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for migration lock held by %s since %s", holder, lockedAt.Format(time.RFC3339))
+		}
+		time.Sleep(time.Second)
+	}
+
+	return func() {
+		c.exec(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`, owner)
+	}, nil
+}
+
+func (c Client) appliedMigrations() (map[int]time.Time, error) {
+	rows, err := c.query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Migrate applies every pending migration.
+func (c Client) Migrate() error {
+	err := c.ensureMigrationTables()
+	if err != nil {
+		return err
+	}
+	release, err := c.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	applied, err := c.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		err := c.runMigration(m.up, func(tx migrationTx) error {
+			return tx.exec(
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version,
+				m.name,
+				time.Now().UTC(),
+			)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown rolls back the most recently applied migrations, newest first.
+func (c Client) MigrateDown(steps int) error {
+	err := c.ensureMigrationTables()
+	if err != nil {
+		return err
+	}
+	release, err := c.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	applied, err := c.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		err := c.runMigration(m.down, func(tx migrationTx) error {
+			return tx.exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+		})
+		if err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", m.version, m.name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+func (c Client) runMigration(apply, record func(tx migrationTx) error) error {
+	sqlTx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	tx := migrationTx{Tx: sqlTx, dialect: c.dialect}
+	if err := apply(tx); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func (c Client) MigrationStatus() ([]MigrationStatus, error) {
+	err := c.ensureMigrationTables()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := c.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if appliedAt, ok := applied[m.version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
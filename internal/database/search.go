@@ -0,0 +1,231 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Snippet highlights are wrapped in control characters inside the database so
+// the text can be HTML escaped before the <mark> tags go in.
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+const sqliteDriverName = "sqlite3_tubely"
+
+func init() {
+	// FTS5 only exists when go-sqlite3 is built with the sqlite_fts5 tag, so
+	// FTS4 is the fallback. It has no built in ranking; this provides one.
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("fts4_rank", fts4Rank, true)
+		},
+	})
+}
+
+// fts4Rank scores a row from matchinfo(table, 'pcx'), weighting title
+// matches above description matches. Column 0 is the unindexed video ID.
+func fts4Rank(matchinfo []byte) float64 {
+	ints := make([]uint32, len(matchinfo)/4)
+	for i := range ints {
+		ints[i] = binary.NativeEndian.Uint32(matchinfo[i*4:])
+	}
+	if len(ints) < 2 {
+		return 0
+	}
+	phrases, columns := int(ints[0]), int(ints[1])
+	weights := []float64{0, 10, 1}
+
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for col := 0; col < columns && col < len(weights); col++ {
+			i := 2 + 3*(p*columns+col)
+			if i+1 >= len(ints) {
+				return score
+			}
+			hitsInRow, hitsInAllRows := ints[i], ints[i+1]
+			if hitsInRow > 0 && hitsInAllRows > 0 {
+				score += weights[col] * float64(hitsInRow) / float64(hitsInAllRows)
+			}
+		}
+	}
+	return score
+}
+
+type VideoSearchResult struct {
+	Video              Video   `json:"video"`
+	TitleSnippet       string  `json:"title_snippet"`
+	DescriptionSnippet string  `json:"description_snippet"`
+	Score              float64 `json:"score"`
+}
+
+type SearchVideosParams struct {
+	Query  string
+	UserID uuid.UUID
+	Limit  int
+	Offset int
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// syncVideoSearch replaces the search index entry of a video. Call it in the
+// same transaction as the write that changed the video.
+func (c Client) syncVideoSearch(ex execer, id uuid.UUID, title, description string) error {
+	if c.dialect == dialectPostgres {
+		_, err := ex.Exec(c.dialect.rebind(`
+		INSERT INTO videos_search (video_id, document)
+		VALUES (?, setweight(to_tsvector('english', ?), 'A') || setweight(to_tsvector('english', ?), 'B'))
+		ON CONFLICT (video_id) DO UPDATE SET document = EXCLUDED.document
+		`), id, title, description)
+		return err
+	}
+
+	err := c.deleteVideoSearch(ex, id)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO videos_fts (video_id, title, description) VALUES (?, ?, ?)`, id, title, description)
+	return err
+}
+
+func (d dialect) searchTable() string {
+	if d == dialectPostgres {
+		return "videos_search"
+	}
+	return "videos_fts"
+}
+
+func (c Client) deleteVideoSearch(ex execer, id uuid.UUID) error {
+	_, err := ex.Exec(c.dialect.rebind(`DELETE FROM `+c.dialect.searchTable()+` WHERE video_id = ?`), id)
+	return err
+}
+
+func (c Client) resetVideoSearch() error {
+	_, err := c.exec(`DELETE FROM ` + c.dialect.searchTable())
+	return err
+}
+
+// ftsQuery turns free text into an FTS query that matches rows containing
+// every word, so user input can't produce a syntax error.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, `"`+word+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (c Client) sqliteFTSVersion() (string, error) {
+	var ddl string
+	err := c.queryRow(`SELECT sql FROM sqlite_master WHERE name = 'videos_fts'`).Scan(&ddl)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(strings.ToLower(ddl), "fts5") {
+		return "fts5", nil
+	}
+	return "fts4", nil
+}
+
+// SearchVideos returns the user's own videos and everyone's public videos
+// matching the query, best match first.
+func (c Client) SearchVideos(params SearchVideosParams) ([]VideoSearchResult, error) {
+	var query string
+	var args []any
+
+	if c.dialect == dialectPostgres {
+		headline := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=20, MinWords=5", highlightStart, highlightEnd)
+		query = `
+		SELECT` + prefixColumns("v", videoColumns) + `,
+			ts_headline('english', v.title, q, ?),
+			ts_headline('english', COALESCE(v.description, ''), q, ?),
+			ts_rank(s.document, q) AS score
+		FROM videos_search s
+		JOIN videos v ON v.id = s.video_id
+		CROSS JOIN websearch_to_tsquery('english', ?) q
+		WHERE s.document @@ q AND (v.user_id = ? OR v.visibility = 'public')
+		ORDER BY score DESC, v.id
+		LIMIT ? OFFSET ?
+		`
+		args = []any{headline, headline, params.Query, params.UserID, params.Limit, params.Offset}
+	} else {
+		match := ftsQuery(params.Query)
+		if match == "" {
+			return []VideoSearchResult{}, nil
+		}
+
+		version, err := c.sqliteFTSVersion()
+		if err != nil {
+			return nil, err
+		}
+		titleSnippet := fmt.Sprintf(`snippet(videos_fts, 1, '%s', '%s', '…', 12)`, highlightStart, highlightEnd)
+		descriptionSnippet := fmt.Sprintf(`snippet(videos_fts, 2, '%s', '%s', '…', 24)`, highlightStart, highlightEnd)
+		score := `-bm25(videos_fts, 0.0, 10.0, 1.0)`
+		if version == "fts4" {
+			titleSnippet = fmt.Sprintf(`snippet(videos_fts, '%s', '%s', '…', 1, 12)`, highlightStart, highlightEnd)
+			descriptionSnippet = fmt.Sprintf(`snippet(videos_fts, '%s', '%s', '…', 2, 24)`, highlightStart, highlightEnd)
+			score = `fts4_rank(matchinfo(videos_fts, 'pcx'))`
+		}
+
+		query = `
+		SELECT` + prefixColumns("v", videoColumns) + `,
+			` + titleSnippet + `,
+			` + descriptionSnippet + `,
+			` + score + ` AS score
+		FROM videos_fts
+		JOIN videos v ON v.id = videos_fts.video_id
+		WHERE videos_fts MATCH ? AND (v.user_id = ? OR v.visibility = 'public')
+		ORDER BY score DESC, v.id
+		LIMIT ? OFFSET ?
+		`
+		args = []any{match, params.UserID, params.Limit, params.Offset}
+	}
+
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []VideoSearchResult{}
+	for rows.Next() {
+		var result VideoSearchResult
+		result.Video, err = scanVideoWith(rows, &result.TitleSnippet, &result.DescriptionSnippet, &result.Score)
+		if err != nil {
+			return nil, err
+		}
+		result.TitleSnippet = highlight(result.TitleSnippet)
+		result.DescriptionSnippet = highlight(result.DescriptionSnippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func highlight(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightEnd, "</mark>")
+}
+
+// prefixColumns qualifies a column list like videoColumns with a table alias.
+func prefixColumns(alias, columns string) string {
+	fields := strings.Split(columns, ",")
+	for i, field := range fields {
+		fields[i] = "\n\t\t" + alias + "." + strings.TrimSpace(field)
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is a resumable video upload in progress. The bytes received so far
+// are kept in storage as parts, one per chunk.
+type Upload struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Offset    int64     `json:"offset"`
+	CreateUploadParams
+}
+
+type CreateUploadParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Length  int64     `json:"length"`
+	// Metadata is the Upload-Metadata header the client created it with.
+	Metadata  string    `json:"metadata"`
+	ExpiresAt time.Time `json:"-"`
+}
+
+const uploadColumns = `
+		id,
+		created_at,
+		expires_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata
+`
+
+func scanUpload(row interface{ Scan(...any) error }) (Upload, error) {
+	var upload Upload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.ExpiresAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Metadata,
+	)
+	return upload, err
+}
+
+func (c Client) CreateUpload(params CreateUploadParams) (Upload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO uploads (
+		id,
+		created_at,
+		expires_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata
+	) VALUES (?, ?, ?, ?, ?, ?, 0, ?)
+	`
+	_, err := c.exec(
+		query,
+		id,
+		time.Now().UTC(),
+		params.ExpiresAt.UTC(),
+		params.VideoID,
+		params.UserID,
+		params.Length,
+		params.Metadata,
+	)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	return c.GetUpload(id)
+}
+
+func (c Client) GetUpload(id uuid.UUID) (Upload, error) {
+	query := `SELECT` + uploadColumns + `FROM uploads WHERE id = ?`
+	upload, err := scanUpload(c.queryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, nil
+		}
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// UploadPart is a chunk of an upload, stored under its own key.
+type UploadPart struct {
+	UploadID uuid.UUID `json:"upload_id"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	Key      string    `json:"key"`
+}
+
+// AddUploadPart records a stored chunk that starts at the upload's current
+// offset, moves the offset past it and pushes back the expiry. It returns
+// false if the offset wasn't part.Offset anymore, meaning another request
+// got there first.
+func (c Client) AddUploadPart(part UploadPart, expiresAt time.Time) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE uploads
+	SET upload_offset = ?, expires_at = ?
+	WHERE id = ? AND upload_offset = ?
+	`
+	result, err := tx.Exec(c.dialect.rebind(query), part.Offset+part.Size, expiresAt.UTC(), part.UploadID, part.Offset)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+
+	query = `
+	INSERT INTO upload_parts (
+		upload_id,
+		part_offset,
+		size,
+		object_key
+	) VALUES (?, ?, ?, ?)
+	`
+	_, err = tx.Exec(c.dialect.rebind(query), part.UploadID, part.Offset, part.Size, part.Key)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// UploadParts returns an upload's parts in order.
+func (c Client) UploadParts(uploadID uuid.UUID) ([]UploadPart, error) {
+	query := `
+	SELECT upload_id, part_offset, size, object_key
+	FROM upload_parts
+	WHERE upload_id = ?
+	ORDER BY part_offset
+	`
+	rows, err := c.query(query, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []UploadPart{}
+	for rows.Next() {
+		var part UploadPart
+		err := rows.Scan(&part.UploadID, &part.Offset, &part.Size, &part.Key)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+// LockUpload takes the lock on an upload until the lease runs out, so only
+// one request at a time works on it whichever instance it lands on. It
+// returns false if the lock is held under another token, or the upload is
+// gone.
+func (c Client) LockUpload(id, token uuid.UUID, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE uploads
+	SET lock_token = ?, locked_until = ?
+	WHERE id = ? AND (locked_until IS NULL OR locked_until < ?)
+	`
+	result, err := c.exec(query, token, now.Add(lease), id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// ExtendUploadLock keeps a long request from losing the lock on an upload.
+func (c Client) ExtendUploadLock(id, token uuid.UUID, lease time.Duration) error {
+	query := `
+	UPDATE uploads
+	SET locked_until = ?
+	WHERE id = ? AND lock_token = ?
+	`
+	_, err := c.exec(query, time.Now().UTC().Add(lease), id, token)
+	return err
+}
+
+func (c Client) UnlockUpload(id, token uuid.UUID) error {
+	query := `
+	UPDATE uploads
+	SET lock_token = NULL, locked_until = NULL
+	WHERE id = ? AND lock_token = ?
+	`
+	_, err := c.exec(query, id, token)
+	return err
+}
+
+// DeleteUpload removes an upload and its parts, recording its stored files
+// for deletion in the same transaction.
+func (c Client) DeleteUpload(id uuid.UUID, files []CreatePendingDeletionParams) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(c.dialect.rebind(`DELETE FROM upload_parts WHERE upload_id = ?`), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(c.dialect.rebind(`DELETE FROM uploads WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	err = c.createPendingDeletions(tx, files)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAllUploads returns every upload in progress.
+func (c Client) GetAllUploads() ([]Upload, error) {
+	return c.queryUploads(`SELECT` + uploadColumns + `FROM uploads`)
+}
+
+// ExpiredUploads returns the uploads that expired before now.
+func (c Client) ExpiredUploads(now time.Time) ([]Upload, error) {
+	query := `SELECT` + uploadColumns + `FROM uploads WHERE expires_at < ?`
+	return c.queryUploads(query, now.UTC())
+}
+
+func (c Client) queryUploads(query string, args ...any) ([]Upload, error) {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
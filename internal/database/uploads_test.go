@@ -0,0 +1,200 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newUpload(t *testing.T, c Client, f fixture, expiresAt time.Time) Upload {
+	t.Helper()
+	upload, err := c.CreateUpload(CreateUploadParams{
+		VideoID:   f.video.ID,
+		UserID:    f.user.ID,
+		Length:    100,
+		Metadata:  "filename Ym9vdHMubXA0",
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("CreateUpload: %v", err)
+	}
+	return upload
+}
+
+func getUpload(t *testing.T, c Client, id uuid.UUID) Upload {
+	t.Helper()
+	upload, err := c.GetUpload(id)
+	if err != nil {
+		t.Fatalf("GetUpload: %v", err)
+	}
+	return upload
+}
+
+func TestAddUploadPart(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		upload := newUpload(t, c, f, time.Now().Add(time.Hour))
+		if upload.Offset != 0 || upload.Length != 100 || upload.VideoID != f.video.ID {
+			t.Fatalf("got %+v, want an empty upload of 100 bytes", upload)
+		}
+
+		first := UploadPart{UploadID: upload.ID, Offset: 0, Size: 40, Key: "uploads/a"}
+		later := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+		ok, err := c.AddUploadPart(first, later)
+		if err != nil || !ok {
+			t.Fatalf("AddUploadPart: %v, %v", ok, err)
+		}
+		upload = getUpload(t, c, upload.ID)
+		if upload.Offset != 40 {
+			t.Errorf("got offset %d, want 40", upload.Offset)
+		}
+		if !upload.ExpiresAt.Equal(later) {
+			t.Errorf("got expiry %v, want %v", upload.ExpiresAt, later)
+		}
+
+		// A request that read the old offset loses, and its part isn't
+		// recorded.
+		ok, err = c.AddUploadPart(UploadPart{UploadID: upload.ID, Offset: 0, Size: 10, Key: "uploads/stale"}, later)
+		if err != nil || ok {
+			t.Fatalf("AddUploadPart at a stale offset: %v, %v", ok, err)
+		}
+
+		second := UploadPart{UploadID: upload.ID, Offset: 40, Size: 60, Key: "uploads/b"}
+		ok, err = c.AddUploadPart(second, later)
+		if err != nil || !ok {
+			t.Fatalf("AddUploadPart: %v, %v", ok, err)
+		}
+		parts, err := c.UploadParts(upload.ID)
+		if err != nil {
+			t.Fatalf("UploadParts: %v", err)
+		}
+		if want := []UploadPart{first, second}; !reflect.DeepEqual(parts, want) {
+			t.Errorf("got parts %+v, want %+v", parts, want)
+		}
+	})
+}
+
+func TestLockUpload(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		upload := newUpload(t, c, f, time.Now().Add(time.Hour))
+		first, second := uuid.New(), uuid.New()
+
+		lock := func(token uuid.UUID, lease time.Duration) bool {
+			t.Helper()
+			ok, err := c.LockUpload(upload.ID, token, lease)
+			if err != nil {
+				t.Fatalf("LockUpload: %v", err)
+			}
+			return ok
+		}
+
+		if !lock(first, time.Minute) {
+			t.Fatal("couldn't lock a free upload")
+		}
+		if lock(second, time.Minute) {
+			t.Fatal("locked an upload someone else holds")
+		}
+		// Only the holder's token unlocks it.
+		err := c.UnlockUpload(upload.ID, second)
+		if err != nil {
+			t.Fatalf("UnlockUpload: %v", err)
+		}
+		if lock(second, time.Minute) {
+			t.Fatal("the wrong token unlocked the upload")
+		}
+		err = c.UnlockUpload(upload.ID, first)
+		if err != nil {
+			t.Fatalf("UnlockUpload: %v", err)
+		}
+		if !lock(second, -time.Second) {
+			t.Fatal("couldn't lock an unlocked upload")
+		}
+
+		// A holder that went away without unlocking loses the lock when its
+		// lease runs out, unless it extends it in time.
+		if !lock(first, time.Minute) {
+			t.Fatal("couldn't take over an expired lock")
+		}
+		err = c.ExtendUploadLock(upload.ID, first, -time.Second)
+		if err != nil {
+			t.Fatalf("ExtendUploadLock: %v", err)
+		}
+		err = c.ExtendUploadLock(upload.ID, second, time.Hour)
+		if err != nil {
+			t.Fatalf("ExtendUploadLock: %v", err)
+		}
+		if !lock(second, time.Minute) {
+			t.Fatal("a lock was extended with the wrong token")
+		}
+
+		ok, err := c.LockUpload(uuid.New(), first, time.Minute)
+		if err != nil || ok {
+			t.Errorf("LockUpload of a missing upload: %v, %v", ok, err)
+		}
+	})
+}
+
+func TestDeleteUpload(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		upload := newUpload(t, c, f, time.Now().Add(time.Hour))
+		kept := newUpload(t, c, f, time.Now().Add(time.Hour))
+		for _, u := range []Upload{upload, kept} {
+			_, err := c.AddUploadPart(UploadPart{UploadID: u.ID, Size: 10, Key: "uploads/" + u.ID.String() + "/a"}, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatalf("AddUploadPart: %v", err)
+			}
+		}
+
+		files := []CreatePendingDeletionParams{{Store: "video", Key: "uploads/" + upload.ID.String() + "/"}}
+		err := c.DeleteUpload(upload.ID, files)
+		if err != nil {
+			t.Fatalf("DeleteUpload: %v", err)
+		}
+
+		if got := getUpload(t, c, upload.ID); got.ID != uuid.Nil {
+			t.Error("upload is still there")
+		}
+		parts, err := c.UploadParts(upload.ID)
+		if err != nil {
+			t.Fatalf("UploadParts: %v", err)
+		}
+		if len(parts) != 0 {
+			t.Errorf("%d parts are left", len(parts))
+		}
+		parts, err = c.UploadParts(kept.ID)
+		if err != nil {
+			t.Fatalf("UploadParts: %v", err)
+		}
+		if len(parts) != 1 {
+			t.Errorf("the other upload has %d parts, want 1", len(parts))
+		}
+		checkPendingDeletions(t, c, files)
+	})
+}
+
+func TestExpiredUploads(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		expired := newUpload(t, c, f, time.Now().Add(-time.Minute))
+		newUpload(t, c, f, time.Now().Add(time.Hour))
+
+		uploads, err := c.ExpiredUploads(time.Now())
+		if err != nil {
+			t.Fatalf("ExpiredUploads: %v", err)
+		}
+		if len(uploads) != 1 || uploads[0].ID != expired.ID {
+			t.Errorf("got %+v, want only upload %s", uploads, expired.ID)
+		}
+		all, err := c.GetAllUploads()
+		if err != nil {
+			t.Fatalf("GetAllUploads: %v", err)
+		}
+		if len(all) != 2 {
+			t.Errorf("got %d uploads, want 2", len(all))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUsers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		user, err := c.CreateUser(CreateUserParams{Email: "boots@example.com", Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		got, err := c.GetUserByEmail("boots@example.com")
+		if err != nil {
+			t.Fatalf("GetUserByEmail: %v", err)
+		}
+		if got.ID != user.ID || got.Password != "hash" {
+			t.Errorf("got %+v, want %+v", got, user)
+		}
+		missing, err := c.GetUserByEmail("nobody@example.com")
+		if err != nil || missing.ID != uuid.Nil {
+			t.Errorf("GetUserByEmail of a missing user: %+v, %v", missing, err)
+		}
+
+		err = c.DeleteUser(user.ID)
+		if err != nil {
+			t.Fatalf("DeleteUser: %v", err)
+		}
+		deleted, err := c.GetUser(user.ID)
+		if err != nil || deleted != nil {
+			t.Errorf("GetUser of a deleted user: %+v, %v", deleted, err)
+		}
+	})
+}
+
+func TestRefreshTokens(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+		token, err := c.CreateRefreshToken(CreateRefreshTokenParams{Token: "abc123", UserID: f.user.ID, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("CreateRefreshToken: %v", err)
+		}
+		if token.UserID != f.user.ID || !token.ExpiresAt.Equal(expiresAt) || token.RevokedAt != nil {
+			t.Errorf("got %+v, want an unrevoked token of the user's", token)
+		}
+
+		user, err := c.GetUserByRefreshToken("abc123")
+		if err != nil {
+			t.Fatalf("GetUserByRefreshToken: %v", err)
+		}
+		if user == nil || user.ID != f.user.ID {
+			t.Errorf("got %+v, want the token's user", user)
+		}
+
+		err = c.RevokeRefreshToken("abc123")
+		if err != nil {
+			t.Fatalf("RevokeRefreshToken: %v", err)
+		}
+		token, err = c.GetRefreshToken("abc123")
+		if err != nil {
+			t.Fatalf("GetRefreshToken: %v", err)
+		}
+		if token.RevokedAt == nil {
+			t.Error("token wasn't revoked")
+		}
+
+		err = c.DeleteRefreshToken("abc123")
+		if err != nil {
+			t.Fatalf("DeleteRefreshToken: %v", err)
+		}
+		if token, _ := c.GetRefreshToken("abc123"); token.Token != "" {
+			t.Error("token is still there")
+		}
+	})
+}
@@ -3,6 +3,9 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,33 +16,138 @@ type Video struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailKey locates the thumbnail in the video store, and the API
+	// links to it as ThumbnailURL. ThumbnailURL is only stored for
+	// thumbnails kept elsewhere, such as ones saved to local disk before
+	// thumbnails moved to object storage.
+	ThumbnailKey *string `json:"-"`
+	// VideoKey and HLSKey locate the published MP4 and HLS master playlist
+	// in the video store. Clients never see them; the API turns them into
+	// short-lived VideoURL and HLSURL links each time it returns a video.
+	VideoKey *string `json:"-"`
+	HLSKey   *string `json:"-"`
+	VideoURL *string `json:"video_url"`
+	HLSURL   *string `json:"hls_url"`
+	MediaInfo
 	CreateVideoParams
 }
 
+// MediaInfo is the technical metadata ffprobe reports for the published
+// file. Every field is nil until a video file has been processed.
+type MediaInfo struct {
+	Duration   *float64 `json:"duration"`
+	Width      *int     `json:"width"`
+	Height     *int     `json:"height"`
+	FrameRate  *float64 `json:"frame_rate"`
+	VideoCodec *string  `json:"video_codec"`
+	AudioCodec *string  `json:"audio_codec"`
+	BitRate    *int64   `json:"bit_rate"`
+	FileSize   *int64   `json:"file_size"`
+	Rotation   *int     `json:"rotation"`
+	// Orientation is "landscape", "portrait", "square", "ultrawide" or
+	// "other".
+	Orientation *string `json:"orientation"`
+}
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Visibility  Visibility `json:"visibility"`
+	UserID      uuid.UUID  `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// Visibility decides who can see a video. Public videos are listed and
+// searchable by everyone, unlisted ones can be opened by anyone who has the
+// ID, and private ones only by their owner.
+type Visibility string
+
+const (
+	VisibilityPublic   Visibility = "public"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPrivate  Visibility = "private"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// VisibleTo reports whether userID may see the video. Pass uuid.Nil for
+// anonymous callers.
+func (v Video) VisibleTo(userID uuid.UUID) bool {
+	if userID != uuid.Nil && v.UserID == userID {
+		return true
+	}
+	return v.Visibility == VisibilityPublic || v.Visibility == VisibilityUnlisted
+}
+
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
-		video_url,
+		thumbnail_key,
+		video_key,
+		hls_key,
+		duration,
+		width,
+		height,
+		frame_rate,
+		video_codec,
+		audio_codec,
+		bit_rate,
+		file_size,
+		rotation,
+		orientation,
+		visibility,
 		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+`
+
+func scanVideo(row interface{ Scan(...any) error }) (Video, error) {
+	return scanVideoWith(row)
+}
+
+// scanVideoWith scans a row of videoColumns followed by extra columns.
+func scanVideoWith(row interface{ Scan(...any) error }, extra ...any) (Video, error) {
+	var video Video
+	dest := []any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailKey,
+		&video.VideoKey,
+		&video.HLSKey,
+		&video.Duration,
+		&video.Width,
+		&video.Height,
+		&video.FrameRate,
+		&video.VideoCodec,
+		&video.AudioCodec,
+		&video.BitRate,
+		&video.FileSize,
+		&video.Rotation,
+		&video.Orientation,
+		&video.Visibility,
+		&video.UserID,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	return video, err
+}
+
+// GetAllVideos returns every user's videos. It's meant for maintenance
+// tasks that need to see everything stored.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `SELECT` + videoColumns + `FROM videos`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -47,23 +155,13 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
-
-	return videos, nil
+	return videos, rows.Err()
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -75,10 +173,28 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		visibility,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(c.dialect.rebind(query), id, params.Title, params.Description, params.Visibility, params.UserID)
+	if err != nil {
+		return Video{}, err
+	}
+	err = c.syncVideoSearch(tx, id, params.Title, params.Description)
+	if err != nil {
+		return Video{}, err
+	}
+	err = tx.Commit()
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +204,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.queryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +220,424 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
-	query := `
+var (
+	ErrVideoModified = errors.New("video was modified by someone else")
+	ErrVideoNotFound = errors.New("video not found")
+)
+
+// updateVideoQuery saves everything but the video's keys, which only change
+// along with the blob references in setVideoBlob and SetHLSKey.
+const updateVideoQuery = `
 	UPDATE videos
 	SET
+		updated_at = ?,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
-		video_url = ?,
+		thumbnail_key = ?,
+		duration = ?,
+		width = ?,
+		height = ?,
+		frame_rate = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		bit_rate = ?,
+		file_size = ?,
+		rotation = ?,
+		orientation = ?,
+		visibility = ?,
 		user_id = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
-		query,
+func updateVideoArgs(video Video) []any {
+	// Microseconds are the most both SQLite and Postgres round-trip exactly,
+	// and updated_at doubles as the video's ETag.
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	return []any{
+		now,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
-		&video.VideoURL,
+		&video.ThumbnailKey,
+		video.Duration,
+		video.Width,
+		video.Height,
+		video.FrameRate,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.BitRate,
+		video.FileSize,
+		video.Rotation,
+		video.Orientation,
+		video.Visibility,
 		video.UserID,
 		video.ID,
-	)
-	return err
+	}
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+func (c Client) UpdateVideo(video Video) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(c.dialect.rebind(updateVideoQuery), updateVideoArgs(video)...)
+	if err != nil {
+		return err
+	}
+	err = c.syncVideoSearch(tx, video.ID, video.Title, video.Description)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateVideoIfUnmodified saves the video only if it hasn't been updated
+// since unmodifiedSince, and returns ErrVideoModified otherwise.
+func (c Client) UpdateVideoIfUnmodified(video Video, unmodifiedSince time.Time) (Video, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
+	lockQuery := `SELECT updated_at FROM videos WHERE id = ?`
+	if c.dialect == dialectPostgres {
+		lockQuery += ` FOR UPDATE`
+	}
+	var updatedAt time.Time
+	err = tx.QueryRow(c.dialect.rebind(lockQuery), video.ID).Scan(&updatedAt)
+	if err != nil {
+		return Video{}, err
+	}
+	if !updatedAt.Equal(unmodifiedSince) {
+		return Video{}, ErrVideoModified
+	}
+
+	_, err = tx.Exec(c.dialect.rebind(updateVideoQuery), updateVideoArgs(video)...)
+	if err != nil {
+		return Video{}, err
+	}
+	err = c.syncVideoSearch(tx, video.ID, video.Title, video.Description)
+	if err != nil {
+		return Video{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Video{}, err
+	}
+
+	return c.GetVideo(video.ID)
+}
+
+// SetVideoThumbnail points the video at the thumbnail stored under key and
+// returns the key or, for thumbnails from before they were stored by key,
+// the URL of the one it replaced. It returns ErrVideoNotFound if the video
+// was deleted.
+func (c Client) SetVideoThumbnail(id uuid.UUID, key string) (previousKey, previousURL *string, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	lockQuery := `SELECT thumbnail_key, thumbnail_url FROM videos WHERE id = ?`
+	if c.dialect == dialectPostgres {
+		lockQuery += ` FOR UPDATE`
+	}
+	err = tx.QueryRow(c.dialect.rebind(lockQuery), id).Scan(&previousKey, &previousURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrVideoNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := `
+	UPDATE videos
+	SET thumbnail_key = ?, thumbnail_url = NULL, updated_at = ?
+	WHERE id = ?
+	`
+	_, err = tx.Exec(c.dialect.rebind(query), key, time.Now().UTC().Truncate(time.Microsecond), id)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return previousKey, previousURL, nil
+}
+
+// MoveVideoThumbnail points the video at a thumbnail copied to key, as long
+// as it still has the one at oldURL. It reports whether it did.
+func (c Client) MoveVideoThumbnail(id uuid.UUID, oldURL, key string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET thumbnail_key = ?, thumbnail_url = NULL, updated_at = ?
+	WHERE id = ? AND thumbnail_url = ?
+	`
+	result, err := c.exec(query, key, time.Now().UTC().Truncate(time.Microsecond), id, oldURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ThumbnailInUse reports whether any video has the thumbnail stored under
+// key or, for thumbnails from before they were stored by key, at url.
+// Videos whose legacy thumbnails were moved together share one key.
+func (c Client) ThumbnailInUse(key, url *string) (bool, error) {
+	var n int
+	err := c.queryRow(`SELECT COUNT(*) FROM videos WHERE thumbnail_key = ? OR thumbnail_url = ?`, key, url).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteVideo deletes the video and, in the same transaction, queues its
+// files for deletion so none are forgotten if removing them fails. The
+// video's blob is released, and only deleted if no other video uses it.
+func (c Client) DeleteVideo(id uuid.UUID, files []CreatePendingDeletionParams, blobFiles BlobFiles) error {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
-	return err
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	videoKey, err := c.lockVideoKey(tx, id)
+	if errors.Is(err, ErrVideoNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.deleteVideoSearch(tx, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(c.dialect.rebind(query), id)
+	if err != nil {
+		return err
+	}
+	err = c.createPendingDeletions(tx, files)
+	if err != nil {
+		return err
+	}
+	if videoKey != nil {
+		err = c.releaseBlob(tx, *videoKey, blobFiles)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type VideoSort string
+
+const (
+	VideoSortCreated  VideoSort = "created"
+	VideoSortUpdated  VideoSort = "updated"
+	VideoSortTitle    VideoSort = "title"
+	VideoSortDuration VideoSort = "duration"
+)
+
+// VideoCursor points just past the last video of a page. Value is the sort
+// key of that video, as returned by the database, so the next page continues
+// exactly where this one stopped.
+type VideoCursor struct {
+	Value any       `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// CheckCursor makes sure a cursor that came back from a client holds the
+// kind of sort key the sort produces, since ListVideos compares it with
+// one.
+func (s VideoSort) CheckCursor(cursor VideoCursor) error {
+	if cursor.ID == uuid.Nil {
+		return errors.New("cursor has no video ID")
+	}
+	if s == VideoSortTitle {
+		if _, ok := cursor.Value.(string); !ok {
+			return fmt.Errorf("cursor for sort %q must hold a title", s)
+		}
+		return nil
+	}
+	// The other sorts are numbers, which come back from Postgres as numeric
+	// text.
+	switch v := cursor.Value.(type) {
+	case float64:
+		return nil
+	case string:
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cursor for sort %q must hold a number", s)
+}
+
+type ListVideosParams struct {
+	// UserID limits the list to one user's videos; uuid.Nil lists everyone's.
+	UserID     uuid.UUID
+	Limit      int
+	Sort       VideoSort
+	Descending bool
+	After      *VideoCursor
+
+	HasVideo      *bool
+	HasThumbnail  *bool
+	Orientation   string
+	Visibility    Visibility
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// sortExpression is what ListVideos orders by. Timestamps are compared as
+// numbers because SQLite stores them as text in more than one format.
+func (d dialect) sortExpression(sort VideoSort) (string, error) {
+	switch sort {
+	case VideoSortCreated, "":
+		return d.timestampNumber("created_at"), nil
+	case VideoSortUpdated:
+		return d.timestampNumber("updated_at"), nil
+	case VideoSortTitle:
+		return "title", nil
+	case VideoSortDuration:
+		return "COALESCE(duration, -1)", nil
+	default:
+		return "", fmt.Errorf("unknown sort %q", sort)
+	}
+}
+
+func (d dialect) timestampNumber(column string) string {
+	if d == dialectPostgres {
+		return fmt.Sprintf("EXTRACT(EPOCH FROM %s)", column)
+	}
+	return fmt.Sprintf("julianday(%s)", column)
+}
+
+func (d dialect) compareTimestamp(column, op string, t time.Time) (string, any) {
+	if d == dialectPostgres {
+		return fmt.Sprintf("%s %s ?", column, op), t.UTC()
+	}
+	return fmt.Sprintf("julianday(%s) %s julianday(?)", column, op), t.UTC().Format("2006-01-02 15:04:05.999999")
+}
+
+// ListVideos returns one page of videos and the cursor for the next page,
+// which is nil on the last page.
+func (c Client) ListVideos(params ListVideosParams) ([]Video, *VideoCursor, error) {
+	sortExpr, err := c.dialect.sortExpression(params.Sort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conditions []string
+	var args []any
+
+	if params.UserID != uuid.Nil {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, params.UserID)
+	}
+	if params.HasVideo != nil {
+		conditions = append(conditions, nullCondition("video_key", *params.HasVideo))
+	}
+	if params.HasThumbnail != nil {
+		conditions = append(conditions, nullCondition("COALESCE(thumbnail_key, thumbnail_url)", *params.HasThumbnail))
+	}
+	if params.Orientation != "" {
+		conditions = append(conditions, "orientation = ?")
+		args = append(args, params.Orientation)
+	}
+	if params.Visibility != "" {
+		conditions = append(conditions, "visibility = ?")
+		args = append(args, params.Visibility)
+	}
+	if params.CreatedAfter != nil {
+		condition, arg := c.dialect.compareTimestamp("created_at", ">=", *params.CreatedAfter)
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if params.CreatedBefore != nil {
+		condition, arg := c.dialect.compareTimestamp("created_at", "<", *params.CreatedBefore)
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	direction, comparison := "ASC", ">"
+	if params.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if params.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sortExpr, comparison))
+		args = append(args, params.After.Value, params.After.Value, params.After.ID)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// Fetch one extra row to find out whether there's another page.
+	query := `
+	SELECT` + videoColumns + `, ` + sortExpr + `
+	FROM videos
+	` + where + `
+	ORDER BY ` + sortExpr + ` ` + direction + `, id ` + direction + `
+	LIMIT ?
+	`
+	args = append(args, params.Limit+1)
+
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	sortKeys := []any{}
+	for rows.Next() {
+		var sortKey any
+		video, err := scanVideoWith(rows, &sortKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		videos = append(videos, video)
+		sortKeys = append(sortKeys, normalizeSortKey(sortKey))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(videos) <= params.Limit {
+		return videos, nil, nil
+	}
+	videos = videos[:params.Limit]
+	last := len(videos) - 1
+	return videos, &VideoCursor{Value: sortKeys[last], ID: videos[last].ID}, nil
+}
+
+func nullCondition(column string, notNull bool) string {
+	if notNull {
+		return column + " IS NOT NULL"
+	}
+	return column + " IS NULL"
+}
+
+// normalizeSortKey turns driver specific values into ones that survive a
+// round trip through the JSON encoded cursor.
+func normalizeSortKey(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case int64:
+		return float64(v)
+	default:
+		return v
+	}
 }
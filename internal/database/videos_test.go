@@ -0,0 +1,433 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func getVideo(t *testing.T, c Client, id uuid.UUID) Video {
+	t.Helper()
+	video, err := c.GetVideo(id)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	return video
+}
+
+// blobFiles is what the video processor stores for a blob.
+func blobFiles(key string) []CreatePendingDeletionParams {
+	return []CreatePendingDeletionParams{{Store: "video", Key: key}, {Store: "video", Key: key + ".hls/"}}
+}
+
+func TestUpdateVideo(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		if f.video.Visibility != VisibilityPrivate || f.video.UserID != f.user.ID {
+			t.Fatalf("got %+v, want a private video of the user's", f.video)
+		}
+
+		video := f.video
+		video.Title = "Boots returns"
+		video.ThumbnailKey = ptr("thumbnails/boots.jpg")
+		video.MediaInfo = MediaInfo{
+			Duration:    ptr(12.5),
+			Width:       ptr(1920),
+			Height:      ptr(1080),
+			FrameRate:   ptr(29.97),
+			VideoCodec:  ptr("h264"),
+			AudioCodec:  ptr("aac"),
+			BitRate:     ptr(int64(4_500_000)),
+			FileSize:    ptr(int64(7_031_250)),
+			Rotation:    ptr(90),
+			Orientation: ptr("portrait"),
+		}
+		err := c.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+
+		got := getVideo(t, c, video.ID)
+		if got.Title != video.Title || got.ThumbnailKey == nil || *got.ThumbnailKey != *video.ThumbnailKey {
+			t.Errorf("got %+v, want the update saved", got)
+		}
+		if *got.Duration != 12.5 || *got.Width != 1920 || *got.FrameRate != 29.97 || *got.BitRate != 4_500_000 || *got.Orientation != "portrait" {
+			t.Errorf("got media info %+v, want what was saved", got.MediaInfo)
+		}
+
+		// updated_at is the ETag, so it has to come back exactly as written.
+		got.Description = "Still a bear"
+		updated, err := c.UpdateVideoIfUnmodified(got, got.UpdatedAt)
+		if err != nil {
+			t.Fatalf("UpdateVideoIfUnmodified: %v", err)
+		}
+		if updated.Description != "Still a bear" || !updated.UpdatedAt.After(got.UpdatedAt) {
+			t.Errorf("got %+v, want the description saved with a later updated_at", updated)
+		}
+		_, err = c.UpdateVideoIfUnmodified(got, got.UpdatedAt)
+		if !errors.Is(err, ErrVideoModified) {
+			t.Errorf("got %v saving over a newer version, want ErrVideoModified", err)
+		}
+	})
+}
+
+func TestVideoBlobs(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		second, err := c.CreateVideo(CreateVideoParams{Title: "Boots again", UserID: f.user.ID})
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+		const hash, key = "5f2b", "landscape/5f2b.mp4"
+
+		video := f.video
+		video.VideoKey = ptr(key)
+		err = c.CreateVideoBlob(video, hash, blobFiles)
+		if err != nil {
+			t.Fatalf("CreateVideoBlob: %v", err)
+		}
+		second.VideoKey = ptr(key)
+		err = c.CreateVideoBlob(second, hash, blobFiles)
+		if !errors.Is(err, ErrBlobExists) {
+			t.Fatalf("got %v making the blob twice, want ErrBlobExists", err)
+		}
+		err = c.ReuseVideoBlob(second, hash, blobFiles)
+		if err != nil {
+			t.Fatalf("ReuseVideoBlob: %v", err)
+		}
+
+		blob, err := c.GetBlob(hash)
+		if err != nil {
+			t.Fatalf("GetBlob: %v", err)
+		}
+		if blob.Key != key || blob.RefCount != 2 {
+			t.Errorf("got %+v, want %s used twice", blob, key)
+		}
+		n, err := c.SetHLSKey(key, key+".hls/master.m3u8")
+		if err != nil || n != 2 {
+			t.Errorf("SetHLSKey updated %d videos (%v), want both", n, err)
+		}
+		if got := getVideo(t, c, second.ID); got.VideoKey == nil || *got.VideoKey != key || got.HLSKey == nil {
+			t.Errorf("got keys %v and %v, want the shared blob's", got.VideoKey, got.HLSKey)
+		}
+
+		// The blob outlives the first video that goes.
+		thumbnail := []CreatePendingDeletionParams{{Store: "asset", Key: "thumbnails/a.jpg"}}
+		err = c.DeleteVideo(f.video.ID, thumbnail, blobFiles)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		if blob, _ := c.GetBlob(hash); blob.RefCount != 1 {
+			t.Errorf("got ref count %d, want 1", blob.RefCount)
+		}
+		checkPendingDeletions(t, c, thumbnail)
+
+		// Publishing the second video as another file lets the blob go.
+		second.VideoKey = ptr("landscape/77aa.mp4")
+		err = c.CreateVideoBlob(second, "77aa", blobFiles)
+		if err != nil {
+			t.Fatalf("CreateVideoBlob: %v", err)
+		}
+		if blob, _ := c.GetBlob(hash); blob.Hash != "" {
+			t.Errorf("got %+v, want the unused blob deleted", blob)
+		}
+		checkPendingDeletions(t, c, append(thumbnail, blobFiles(key)...))
+
+		video.ID = second.ID
+		video.VideoKey = ptr(key)
+		err = c.ReuseVideoBlob(video, hash, blobFiles)
+		if !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("got %v reusing a deleted blob, want ErrBlobNotFound", err)
+		}
+		video.ID = uuid.New()
+		err = c.CreateVideoBlob(video, "9c1d", blobFiles)
+		if !errors.Is(err, ErrVideoNotFound) {
+			t.Errorf("got %v publishing a missing video, want ErrVideoNotFound", err)
+		}
+	})
+}
+
+func TestVideoBlobKeepsEdits(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		second, err := c.CreateVideo(CreateVideoParams{Title: "Boots again", UserID: f.user.ID})
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+
+		// What the processor read before it started, and what the owner
+		// changed while it worked.
+		stale := f.video
+		edited := f.video
+		edited.Title = "Boots, edited"
+		edited.Visibility = VisibilityPublic
+		edited.ThumbnailKey = ptr("thumbnails/uploaded.jpg")
+		err = c.UpdateVideo(edited)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+
+		stale.VideoKey = ptr("landscape/5f2b.mp4")
+		stale.ThumbnailKey = ptr("thumbnails/generated.jpg")
+		stale.Duration = ptr(12.5)
+		err = c.CreateVideoBlob(stale, "5f2b", blobFiles)
+		if err != nil {
+			t.Fatalf("CreateVideoBlob: %v", err)
+		}
+		got := getVideo(t, c, f.video.ID)
+		if got.Title != edited.Title || got.Visibility != VisibilityPublic || *got.ThumbnailKey != *edited.ThumbnailKey {
+			t.Errorf("got %+v, want the edits kept", got)
+		}
+		if got.VideoKey == nil || *got.VideoKey != *stale.VideoKey || got.Duration == nil || *got.Duration != 12.5 {
+			t.Errorf("got %+v, want the blob and its media info saved", got)
+		}
+		if !got.UpdatedAt.After(edited.UpdatedAt) {
+			t.Error("updated_at didn't move on")
+		}
+		if results, _ := c.SearchVideos(SearchVideosParams{Query: "edited", UserID: f.user.ID, Limit: 10}); len(results) != 1 {
+			t.Errorf("got %d search results for the new title, want 1", len(results))
+		}
+
+		// A video with no thumbnail of its own gets the generated one.
+		staleSecond := second
+		second.Description = "Edited too"
+		err = c.UpdateVideo(second)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		staleSecond.VideoKey = stale.VideoKey
+		staleSecond.ThumbnailKey = ptr("thumbnails/generated-2.jpg")
+		err = c.ReuseVideoBlob(staleSecond, "5f2b", blobFiles)
+		if err != nil {
+			t.Fatalf("ReuseVideoBlob: %v", err)
+		}
+		got = getVideo(t, c, second.ID)
+		if got.Description != "Edited too" || got.ThumbnailKey == nil || *got.ThumbnailKey != *staleSecond.ThumbnailKey {
+			t.Errorf("got %+v, want the edit kept and the generated thumbnail saved", got)
+		}
+	})
+}
+
+func TestDeleteVideo(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		files := []CreatePendingDeletionParams{{Store: "asset", Key: "thumbnails/a.jpg"}}
+		err := c.DeleteVideo(f.video.ID, files, blobFiles)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		if got := getVideo(t, c, f.video.ID); got.ID != uuid.Nil {
+			t.Error("video is still there")
+		}
+		checkPendingDeletions(t, c, files)
+
+		// Deleting it again does nothing.
+		err = c.DeleteVideo(f.video.ID, files, blobFiles)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		checkPendingDeletions(t, c, files)
+	})
+}
+
+func TestSetVideoThumbnail(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		video := f.video
+		video.ThumbnailURL = ptr("http://localhost:8091/assets/old.jpg")
+		err := c.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+
+		previousKey, previousURL, err := c.SetVideoThumbnail(video.ID, "thumbnails/a.jpg")
+		if err != nil {
+			t.Fatalf("SetVideoThumbnail: %v", err)
+		}
+		if previousKey != nil || previousURL == nil || *previousURL != *video.ThumbnailURL {
+			t.Errorf("got previous %v / %v, want the legacy URL", previousKey, previousURL)
+		}
+
+		// An edit made since the video was read is kept.
+		edited := getVideo(t, c, video.ID)
+		edited.Title = "Boots, edited"
+		err = c.UpdateVideo(edited)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		previousKey, previousURL, err = c.SetVideoThumbnail(video.ID, "thumbnails/b.jpg")
+		if err != nil {
+			t.Fatalf("SetVideoThumbnail: %v", err)
+		}
+		if previousKey == nil || *previousKey != "thumbnails/a.jpg" || previousURL != nil {
+			t.Errorf("got previous %v / %v, want thumbnails/a.jpg", previousKey, previousURL)
+		}
+		got := getVideo(t, c, video.ID)
+		if got.Title != edited.Title || got.ThumbnailURL != nil || got.ThumbnailKey == nil || *got.ThumbnailKey != "thumbnails/b.jpg" {
+			t.Errorf("got %+v, want the edit kept and only the new key", got)
+		}
+		if !got.UpdatedAt.After(edited.UpdatedAt) {
+			t.Error("updated_at didn't move on")
+		}
+
+		_, _, err = c.SetVideoThumbnail(uuid.New(), "thumbnails/c.jpg")
+		if !errors.Is(err, ErrVideoNotFound) {
+			t.Errorf("got %v for a missing video, want ErrVideoNotFound", err)
+		}
+	})
+}
+
+func TestMoveVideoThumbnail(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		video := f.video
+		video.ThumbnailURL = ptr("http://localhost:8091/assets/old.jpg")
+		err := c.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+
+		moved, err := c.MoveVideoThumbnail(video.ID, "http://localhost:8091/assets/other.jpg", "thumbnails/new.jpg")
+		if err != nil || moved {
+			t.Fatalf("MoveVideoThumbnail from the wrong URL: %v, %v", moved, err)
+		}
+		moved, err = c.MoveVideoThumbnail(video.ID, *video.ThumbnailURL, "thumbnails/new.jpg")
+		if err != nil || !moved {
+			t.Fatalf("MoveVideoThumbnail: %v, %v", moved, err)
+		}
+		got := getVideo(t, c, video.ID)
+		if got.ThumbnailURL != nil || got.ThumbnailKey == nil || *got.ThumbnailKey != "thumbnails/new.jpg" {
+			t.Errorf("got thumbnail %v / %v, want only the key", got.ThumbnailURL, got.ThumbnailKey)
+		}
+
+		inUse, err := c.ThumbnailInUse(ptr("thumbnails/new.jpg"), nil)
+		if err != nil || !inUse {
+			t.Errorf("ThumbnailInUse of the new key: %v, %v", inUse, err)
+		}
+		inUse, err = c.ThumbnailInUse(nil, video.ThumbnailURL)
+		if err != nil || inUse {
+			t.Errorf("ThumbnailInUse of the old URL: %v, %v", inUse, err)
+		}
+	})
+}
+
+func TestListVideos(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		other := newFixture(t, c)
+		titles := []string{"Echo", "Alpha", "Delta", "Bravo", "Charlie"}
+		for i, title := range titles {
+			video, err := c.CreateVideo(CreateVideoParams{Title: title, UserID: f.user.ID, Visibility: VisibilityPublic})
+			if err != nil {
+				t.Fatalf("CreateVideo: %v", err)
+			}
+			video.Duration = ptr(float64(i))
+			err = c.UpdateVideo(video)
+			if err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			params ListVideosParams
+			want   []string
+		}{
+			{
+				name:   "by title",
+				params: ListVideosParams{UserID: f.user.ID, Sort: VideoSortTitle},
+				want:   []string{"Alpha", "Boots", "Bravo", "Charlie", "Delta", "Echo"},
+			},
+			{
+				name:   "by duration descending",
+				params: ListVideosParams{UserID: f.user.ID, Sort: VideoSortDuration, Descending: true},
+				want:   []string{"Charlie", "Bravo", "Delta", "Alpha", "Echo", "Boots"},
+			},
+			{
+				name:   "private only",
+				params: ListVideosParams{UserID: f.user.ID, Sort: VideoSortTitle, Visibility: VisibilityPrivate},
+				want:   []string{"Boots"},
+			},
+			{
+				name:   "everyone's",
+				params: ListVideosParams{Sort: VideoSortTitle, Visibility: VisibilityPrivate},
+				want:   []string{"Boots", "Boots"},
+			},
+			{
+				name:   "created in the future",
+				params: ListVideosParams{UserID: other.user.ID, CreatedAfter: ptr(time.Now().Add(time.Hour))},
+				want:   []string{},
+			},
+			{
+				name:   "created in the past",
+				params: ListVideosParams{UserID: other.user.ID, CreatedBefore: ptr(time.Now().Add(time.Hour))},
+				want:   []string{"Boots"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				// Two at a time, so the cursor carries each sort key over
+				// between pages.
+				params := tt.params
+				params.Limit = 2
+				got := []string{}
+				for page := 0; ; page++ {
+					videos, next, err := c.ListVideos(params)
+					if err != nil {
+						t.Fatalf("ListVideos: %v", err)
+					}
+					for _, video := range videos {
+						got = append(got, video.Title)
+					}
+					if next == nil {
+						break
+					}
+					if page > len(tt.want) {
+						t.Fatal("paging doesn't end")
+					}
+					params.After = next
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("got %v, want %v", got, tt.want)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestSearchVideos(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, c Client) {
+		f := newFixture(t, c)
+		_, err := c.CreateVideo(CreateVideoParams{Title: "Cats", Description: "Not a single bear", UserID: f.user.ID})
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+		_, err = c.CreateVideo(CreateVideoParams{Title: "Fish", Description: "Water", UserID: f.user.ID})
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+
+		results, err := c.SearchVideos(SearchVideosParams{Query: "bear", UserID: f.user.ID, Limit: 10})
+		if err != nil {
+			t.Fatalf("SearchVideos: %v", err)
+		}
+		got := []string{}
+		for _, result := range results {
+			got = append(got, result.Video.Title)
+		}
+		if len(got) != 2 {
+			t.Fatalf("got %v, want the two videos about a bear", got)
+		}
+	})
+}
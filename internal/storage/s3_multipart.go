@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MultipartOptions controls how S3Store uploads large objects. Anything
+// bigger than one part is sent as a multipart upload, with up to Concurrency
+// parts in flight at once.
+type MultipartOptions struct {
+	PartSize    int64
+	Concurrency int
+	// PartAttempts is how many times each part is tried before the whole
+	// upload is given up on. This comes on top of the SDK's own retries,
+	// which don't cover checksum mismatches.
+	PartAttempts int
+}
+
+// minPartSize is the smallest part S3 accepts, other than the last one.
+const minPartSize = 5 << 20
+
+// maxParts is the most parts a multipart upload can have.
+const maxParts = 10000
+
+const partRetryDelay = 200 * time.Millisecond
+
+var DefaultMultipartOptions = MultipartOptions{
+	PartSize:     16 << 20,
+	Concurrency:  4,
+	PartAttempts: 3,
+}
+
+func (o MultipartOptions) Validate() error {
+	if o.PartSize < minPartSize {
+		return fmt.Errorf("part size must be at least %d MiB", minPartSize>>20)
+	}
+	if o.Concurrency < 1 {
+		return errors.New("upload concurrency must be at least 1")
+	}
+	if o.PartAttempts < 1 {
+		return errors.New("part attempts must be at least 1")
+	}
+	return nil
+}
+
+// putMultipart uploads first and then the rest of the body as a multipart
+// upload. Memory use is bounded by one part per worker plus the one being
+// read.
+func (s *S3Store) putMultipart(ctx context.Context, key string, first []byte, rest io.Reader, contentType string) (err error) {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		ContentType:       aws.String(contentType),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// S3 keeps, and bills for, the parts of an upload until it's
+		// completed or aborted.
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		_, abortErr := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("couldn't abort multipart upload: %w", abortErr))
+		}
+	}()
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		number int32
+		data   []byte
+	}
+	var (
+		mu        sync.Mutex
+		completed []types.CompletedPart
+		partErr   error
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if partErr == nil {
+			partErr = err
+			cancel()
+		}
+	}
+
+	// Each token is a buffer, allocated on first use, that's passed back
+	// once its part is uploaded.
+	buffers := make(chan []byte, s.multipart.Concurrency)
+	for range s.multipart.Concurrency {
+		buffers <- nil
+	}
+	parts := make(chan part)
+	for range s.multipart.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				done, err := s.uploadPart(partCtx, key, uploadID, p.number, p.data)
+				if err != nil {
+					fail(err)
+				} else {
+					mu.Lock()
+					completed = append(completed, done)
+					mu.Unlock()
+				}
+				buffers <- p.data[:cap(p.data)]
+			}
+		}()
+	}
+
+	<-buffers // first stands in for this one
+	parts <- part{number: 1, data: first}
+	for number := int32(2); partCtx.Err() == nil; number++ {
+		if number > maxParts {
+			fail(fmt.Errorf("object needs more than %d parts", maxParts))
+			break
+		}
+		buf := <-buffers
+		if buf == nil {
+			buf = make([]byte, s.multipart.PartSize)
+		}
+		n, readErr := io.ReadFull(rest, buf[:s.multipart.PartSize])
+		if n > 0 {
+			parts <- part{number: number, data: buf[:n]}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			fail(readErr)
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if partErr != nil {
+		return partErr
+	}
+
+	slices.SortFunc(completed, func(a, b types.CompletedPart) int {
+		return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber))
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// uploadPart sends one part along with its SHA-256, which S3 checks the
+// received bytes against, retrying with backoff if that fails.
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, number int32, data []byte) (types.CompletedPart, error) {
+	sum := sha256.Sum256(data)
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+
+	for attempt := 1; ; attempt++ {
+		out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:         aws.String(s.bucket),
+			Key:            aws.String(key),
+			UploadId:       uploadID,
+			PartNumber:     aws.Int32(number),
+			Body:           bytes.NewReader(data),
+			ContentLength:  aws.Int64(int64(len(data))),
+			ChecksumSHA256: aws.String(checksum),
+		})
+		if err == nil && out.ChecksumSHA256 != nil && *out.ChecksumSHA256 != checksum {
+			err = fmt.Errorf("checksum mismatch: sent %s, stored %s", checksum, *out.ChecksumSHA256)
+		}
+		if err == nil {
+			return types.CompletedPart{
+				PartNumber:     aws.Int32(number),
+				ETag:           out.ETag,
+				ChecksumSHA256: aws.String(checksum),
+			}, nil
+		}
+		if attempt >= s.multipart.PartAttempts || ctx.Err() != nil {
+			return types.CompletedPart{}, fmt.Errorf("couldn't upload part %d: %w", number, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return types.CompletedPart{}, ctx.Err()
+		case <-time.After(partRetryDelay << (attempt - 1)):
+		}
+	}
+}
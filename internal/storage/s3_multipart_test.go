@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/s3fake"
+)
+
+// testMultipartOptions uses the smallest parts S3 allows, so a few
+// megabytes make a multipart upload.
+var testMultipartOptions = MultipartOptions{
+	PartSize:     minPartSize,
+	Concurrency:  3,
+	PartAttempts: 3,
+}
+
+func newTestS3Store(fake *s3fake.Server, opts MultipartOptions) *S3Store {
+	return NewS3Store(fake.Client(), s3fake.Bucket, "https://media.example.com", opts)
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rng := rand.NewChaCha8([32]byte{})
+	rng.Read(data)
+	return data
+}
+
+func TestPutMultipart(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantParts int32
+	}{
+		{name: "exact parts", size: 3 * minPartSize, wantParts: 3},
+		{name: "short last part", size: 2*minPartSize + 1234, wantParts: 3},
+		{name: "one part and a byte", size: minPartSize + 1, wantParts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := s3fake.New(t)
+			store := newTestS3Store(fake, testMultipartOptions)
+			data := randomBytes(tt.size)
+
+			err := store.Put(context.Background(), "landscape/video.mp4", bytes.NewReader(data), "video/mp4")
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			obj, ok := fake.Object("landscape/video.mp4")
+			if !ok {
+				t.Fatal("object wasn't stored")
+			}
+			if !bytes.Equal(obj.Data, data) {
+				t.Errorf("stored %d bytes that differ from the %d sent", len(obj.Data), len(data))
+			}
+			if obj.ContentType != "video/mp4" {
+				t.Errorf("got content type %q, want video/mp4", obj.ContentType)
+			}
+			if len(fake.PartAttempts) != int(tt.wantParts) {
+				t.Errorf("got %d parts, want %d", len(fake.PartAttempts), tt.wantParts)
+			}
+			if len(fake.Completed) != 1 || len(fake.Aborted) != 0 {
+				t.Errorf("got %d completed and %d aborted uploads, want 1 and 0", len(fake.Completed), len(fake.Aborted))
+			}
+		})
+	}
+}
+
+func TestPutSinglePart(t *testing.T) {
+	fake := s3fake.New(t)
+	store := newTestS3Store(fake, testMultipartOptions)
+	data := randomBytes(minPartSize - 1)
+
+	err := store.Put(context.Background(), "thumbnails/a.jpg", bytes.NewReader(data), "image/jpeg")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	obj, ok := fake.Object("thumbnails/a.jpg")
+	if !ok || !bytes.Equal(obj.Data, data) {
+		t.Fatal("object wasn't stored as sent")
+	}
+	if len(fake.Completed) != 0 || len(fake.PartAttempts) != 0 {
+		t.Error("object smaller than a part was sent as a multipart upload")
+	}
+}
+
+func TestPutMultipartRetriesPart(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault s3fake.PartFault
+	}{
+		{name: "server error", fault: s3fake.PartError},
+		{name: "checksum mismatch", fault: s3fake.PartBadChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := s3fake.New(t)
+			// The second part goes wrong twice, then gets through.
+			fake.FaultPart = func(number int32, attempt int) s3fake.PartFault {
+				if number == 2 && attempt < 3 {
+					return tt.fault
+				}
+				return s3fake.PartOK
+			}
+			store := newTestS3Store(fake, testMultipartOptions)
+			data := randomBytes(3 * minPartSize)
+
+			err := store.Put(context.Background(), "video.mp4", bytes.NewReader(data), "video/mp4")
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if got := fake.PartAttempts[2]; got != 3 {
+				t.Errorf("part 2 was tried %d times, want 3", got)
+			}
+			if got := fake.PartAttempts[1]; got != 1 {
+				t.Errorf("part 1 was tried %d times, want 1", got)
+			}
+			obj, _ := fake.Object("video.mp4")
+			if !bytes.Equal(obj.Data, data) {
+				t.Error("stored object differs from what was sent")
+			}
+		})
+	}
+}
+
+func TestPutMultipartAbortsOnFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     s3fake.PartFault
+		body      func(data []byte) io.Reader
+		wantError string
+	}{
+		{
+			name:      "part keeps failing",
+			fault:     s3fake.PartError,
+			wantError: "couldn't upload part 2",
+		},
+		{
+			name:      "checksum keeps mismatching",
+			fault:     s3fake.PartBadChecksum,
+			wantError: "checksum mismatch",
+		},
+		{
+			name: "body fails partway",
+			body: func(data []byte) io.Reader {
+				return io.MultiReader(bytes.NewReader(data[:minPartSize+100]), iotest.ErrReader(errors.New("client went away")))
+			},
+			wantError: "client went away",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := s3fake.New(t)
+			fake.FaultPart = func(number int32, attempt int) s3fake.PartFault {
+				if number == 2 {
+					return tt.fault
+				}
+				return s3fake.PartOK
+			}
+			store := newTestS3Store(fake, testMultipartOptions)
+			data := randomBytes(3 * minPartSize)
+			var body io.Reader = bytes.NewReader(data)
+			if tt.body != nil {
+				body = tt.body(data)
+			}
+
+			err := store.Put(context.Background(), "video.mp4", body, "video/mp4")
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("got error %v, want one about %q", err, tt.wantError)
+			}
+			if _, ok := fake.Object("video.mp4"); ok {
+				t.Error("failed upload was stored")
+			}
+			if len(fake.Aborted) != 1 {
+				t.Errorf("got %d aborted uploads, want 1", len(fake.Aborted))
+			}
+			if n := fake.PendingUploads(); n != 0 {
+				t.Errorf("%d multipart uploads were left open", n)
+			}
+			if tt.fault != s3fake.PartOK {
+				if got := fake.PartAttempts[2]; got != testMultipartOptions.PartAttempts {
+					t.Errorf("part 2 was tried %d times, want %d", got, testMultipartOptions.PartAttempts)
+				}
+			}
+		})
+	}
+}
+
+func TestPutMultipartAbortsOnCancel(t *testing.T) {
+	fake := s3fake.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	fake.FaultPart = func(number int32, attempt int) s3fake.PartFault {
+		// The upload is given up on while part 2 waits for a retry.
+		if number == 2 {
+			cancel()
+			return s3fake.PartError
+		}
+		return s3fake.PartOK
+	}
+	store := newTestS3Store(fake, testMultipartOptions)
+
+	err := store.Put(ctx, "video.mp4", bytes.NewReader(randomBytes(3*minPartSize)), "video/mp4")
+	if err == nil {
+		t.Fatal("Put succeeded after its context was canceled")
+	}
+	if len(fake.Aborted) != 1 || fake.PendingUploads() != 0 {
+		t.Errorf("got %d aborted and %d open uploads, want 1 and 0", len(fake.Aborted), fake.PendingUploads())
+	}
+}
+
+func BenchmarkPutMultipart(b *testing.B) {
+	benchmarks := []struct {
+		name        string
+		concurrency int
+	}{
+		{name: "sequential", concurrency: 1},
+		{name: "concurrent", concurrency: 4},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			fake := s3fake.New(b)
+			opts := testMultipartOptions
+			opts.Concurrency = bm.concurrency
+			store := newTestS3Store(fake, opts)
+			data := randomBytes(8 * minPartSize)
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				err := store.Put(context.Background(), "video.mp4", bytes.NewReader(data), "video/mp4")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
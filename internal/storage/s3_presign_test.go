@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/s3fake"
+)
+
+func fetch(t *testing.T, rawURL string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", rawURL, err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestPresignGet(t *testing.T) {
+	fake := s3fake.New(t)
+	store := newTestS3Store(fake, testMultipartOptions)
+	data := randomBytes(1000)
+	err := store.Put(context.Background(), "landscape/a b+c.mp4", bytes.NewReader(data), "video/mp4")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	signed, err := store.PresignGet(context.Background(), "landscape/a b+c.mp4", 15*time.Minute)
+	if err != nil {
+		t.Fatalf("PresignGet: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", signed, err)
+	}
+	if got := u.Query().Get("X-Amz-Expires"); got != "900" {
+		t.Errorf("got X-Amz-Expires %q, want 900", got)
+	}
+
+	status, body := fetch(t, signed)
+	if status != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("got %d and %d bytes, want 200 and the object", status, len(body))
+	}
+
+	// The signature covers the key, so the URL can't be bent to fetch
+	// another object.
+	tampered := strings.Replace(signed, "landscape/", "portrait/", 1)
+	if status, _ := fetch(t, tampered); status != http.StatusForbidden {
+		t.Errorf("URL for another key got %d, want 403", status)
+	}
+
+	fake.Now = func() time.Time { return time.Now().Add(16 * time.Minute) }
+	if status, _ := fetch(t, signed); status != http.StatusForbidden {
+		t.Errorf("expired URL got %d, want 403", status)
+	}
+}
+
+func TestPresignGetMissingObject(t *testing.T) {
+	fake := s3fake.New(t)
+	store := newTestS3Store(fake, testMultipartOptions)
+
+	// Presigning is done locally, so a missing object only shows up when the
+	// link is used.
+	signed, err := store.PresignGet(context.Background(), "missing.mp4", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignGet: %v", err)
+	}
+	if status, _ := fetch(t, signed); status != http.StatusNotFound {
+		t.Errorf("got %d, want 404", status)
+	}
+}
@@ -0,0 +1,456 @@
+// Package s3fake is an in-process stand-in for the parts of the S3 API that
+// storage.S3Store uses, for tests.
+package s3fake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// Bucket is the only bucket the fake has.
+	Bucket = "tubely-test"
+	// MinPartSize is the smallest part S3 accepts other than the last.
+	MinPartSize = 5 << 20
+
+	accessKeyID     = "AKIDTEST"
+	secretAccessKey = "secret"
+)
+
+// PartFault is what the fake does wrong with an UploadPart request.
+type PartFault int
+
+const (
+	PartOK PartFault = iota
+	// PartError answers with a 500.
+	PartError
+	// PartBadChecksum stores the part but reports a checksum that doesn't
+	// match what was sent, like bytes corrupted on the way.
+	PartBadChecksum
+)
+
+type Object struct {
+	Data         []byte
+	ContentType  string
+	LastModified time.Time
+}
+
+type multipartUpload struct {
+	key         string
+	contentType string
+	parts       map[int32][]byte
+}
+
+// Server serves the fake S3 API, addressed path-style. Presigned URLs have
+// their signature and expiry checked like S3 does; requests the SDK signs
+// in headers are trusted.
+type Server struct {
+	*httptest.Server
+
+	// Now is the fake's clock, which presigned URLs expire by.
+	Now func() time.Time
+	// FaultPart, if set, decides how each UploadPart attempt goes.
+	FaultPart func(number int32, attempt int) PartFault
+
+	mu      sync.Mutex
+	objects map[string]Object
+	uploads map[string]*multipartUpload
+	nextID  int
+	// PartAttempts, Aborted and Completed record multipart uploads. Read
+	// them once the requests are done.
+	PartAttempts map[int32]int
+	Aborted      []string
+	Completed    []string
+}
+
+func New(t testing.TB) *Server {
+	s := &Server{
+		Now:          time.Now,
+		objects:      map[string]Object{},
+		uploads:      map[string]*multipartUpload{},
+		PartAttempts: map[int32]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns an S3 client for the fake. The SDK's own retries are off so
+// tests see every attempt a caller makes.
+func (s *Server) Client() *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(s.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey}, nil
+		}),
+		Retryer: aws.NopRetryer{},
+	})
+}
+
+func (s *Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	return obj, ok
+}
+
+// PendingUploads counts multipart uploads that were neither completed nor
+// aborted.
+func (s *Server) PendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if query.Has("X-Amz-Signature") {
+		code := s.checkPresigned(r)
+		if code != "" {
+			s3Error(w, http.StatusForbidden, code)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.abortMultipartUpload(w, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// checkPresigned checks a request signed in its query string with
+// Signature Version 4 and returns the S3 error code it fails with, if any.
+func (s *Server) checkPresigned(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return "AuthorizationQueryParametersError"
+	}
+	date := query.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", date)
+	if err != nil {
+		return "AuthorizationQueryParametersError"
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires <= 0 {
+		return "AuthorizationQueryParametersError"
+	}
+	if s.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+		return "AccessDenied"
+	}
+	// The credential is the key ID followed by the scope:
+	// date/region/service/aws4_request.
+	credential := strings.Split(query.Get("X-Amz-Credential"), "/")
+	if len(credential) != 5 {
+		return "AuthorizationQueryParametersError"
+	}
+	if credential[0] != accessKeyID {
+		return "InvalidAccessKeyId"
+	}
+
+	var canonicalQuery []string
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	slices.Sort(canonicalQuery)
+
+	signedHeaders := query.Get("X-Amz-SignedHeaders")
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := strings.TrimSpace(r.Header.Get(name))
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + strings.Join(credential[1:], "/") + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range credential[1:] {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(query.Get("X-Amz-Signature"))) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but unreserved characters, as SigV4 wants.
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &multipartUpload{
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		parts:       map[int32][]byte{},
+	}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: Bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	data, err := readBody(r)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	partNumber := int32(number)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	s.PartAttempts[partNumber]++
+	fault := PartOK
+	if s.FaultPart != nil {
+		fault = s.FaultPart(partNumber, s.PartAttempts[partNumber])
+	}
+	if fault == PartError {
+		s3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	upload.parts[partNumber] = data
+	sum := sha256.Sum256(data)
+	if fault == PartBadChecksum {
+		sum[0] ^= 0xff
+	}
+	w.Header().Set("ETag", etag(data))
+	w.Header().Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key, id string) {
+	var body struct {
+		Parts []struct {
+			PartNumber int32
+			ETag       string
+		} `xml:"Part"`
+	}
+	err := xml.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var data bytes.Buffer
+	for i, part := range body.Parts {
+		if i > 0 && part.PartNumber <= body.Parts[i-1].PartNumber {
+			s3Error(w, http.StatusBadRequest, "InvalidPartOrder")
+			return
+		}
+		stored, ok := upload.parts[part.PartNumber]
+		if !ok || etag(stored) != part.ETag {
+			s3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		// Like S3, only the last part may be smaller than the minimum.
+		if i < len(body.Parts)-1 && len(stored) < MinPartSize {
+			s3Error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data.Write(stored)
+	}
+	s.objects[key] = Object{Data: data.Bytes(), ContentType: upload.contentType, LastModified: time.Now()}
+	delete(s.uploads, id)
+	s.Completed = append(s.Completed, id)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: Bucket, Key: key, ETag: etag(data.Bytes())})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[id]; !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	delete(s.uploads, id)
+	s.Aborted = append(s.Aborted, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := readBody(r)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	s.mu.Lock()
+	s.objects[key] = Object{Data: data, ContentType: r.Header.Get("Content-Type"), LastModified: time.Now()}
+	s.mu.Unlock()
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := s.Object(key)
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+	w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag(obj.Data))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(obj.Data)
+	}
+}
+
+// readBody reads a request body, decoding it if the SDK sent it with
+// aws-chunked content encoding.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") && r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return io.ReadAll(r.Body)
+	}
+
+	var data bytes.Buffer
+	body := bufio.NewReader(r.Body)
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// Trailing headers, such as a checksum, follow.
+			return data.Bytes(), nil
+		}
+		_, err = io.CopyN(&data, body, size)
+		if err != nil {
+			return nil, err
+		}
+		_, err = body.Discard(2) // CRLF
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// BlobStore is the minimal set of operations the API needs from a storage
+// backend. Keys are slash separated and never start with a slash.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	URL(key string) string
+}
+
+// Presigner is implemented by stores that can hand out temporary links to
+// objects that aren't publicly readable, and let clients upload straight to
+// them.
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+	PresignPost(ctx context.Context, key, contentType string, maxSize int64, expiry time.Duration) (PresignedPost, error)
+}
+
+// PresignedPost is an HTML form upload straight to the store. Fields must be
+// sent as form fields ahead of the file, which goes in a field named "file".
+type PresignedPost struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+func joinURL(baseURL, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(key, "/")
+}
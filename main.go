@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
-
-	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
@@ -24,16 +31,45 @@ type apiConfig struct {
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
-	s3Client 				 *s3.Client
+	videoStore       storage.BlobStore
+	assetStore       storage.BlobStore
 	port             string
+	publicBaseURL    string
+	thumbnailBaseURL string
+	jobMaxAttempts   int
+	jobWakeup        chan struct{}
+	hlsLadder        []hlsRendition
+	thumbnailOffset  *float64
+	mediaSigner      mediaSigner
+	mediaURLExpiry   time.Duration
+	cloudFront       *cloudFrontConfig
+	uploadsDir       string
+	uploadExpiry     time.Duration
+	deletionsWake    chan struct{}
+	adminAPIKey      string
+	prober           mediaProber
+	transcoder       transcoder
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
+	// DB_URL takes a postgres:// URL, DB_PATH a SQLite file. Either may hold
+	// either kind; the scheme decides.
+	pathToDB := os.Getenv("DB_URL")
 	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+		pathToDB = os.Getenv("DB_PATH")
+	}
+	if pathToDB == "" {
+		log.Fatal("DB_PATH or DB_URL must be set")
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(pathToDB, os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	db, err := database.NewClient(pathToDB)
@@ -61,60 +97,103 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	workerConcurrency, err := envInt("WORKER_CONCURRENCY", 2)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	jobMaxAttempts, err := envInt("JOB_MAX_ATTEMPTS", 5)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	hlsLadder, err := parseHLSLadder(os.Getenv("HLS_LADDER"))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(
-    context.TODO(),
-    config.WithRegion(s3Region),
-	)
+	thumbnailOffset, err := parseThumbnailOffset(os.Getenv("THUMBNAIL_OFFSET"))
 	if err != nil {
-		log.Fatalf("Couldn't get aws config: %v", err)
+		log.Fatal(err)
 	}
 
-	client := s3.NewFromConfig(awsCfg)
+	mediaURLExpiry, err := envDuration("MEDIA_URL_EXPIRY", time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uploadsDir := os.Getenv("UPLOADS_STAGING_DIR")
+	if uploadsDir == "" {
+		uploadsDir = filepath.Join(os.TempDir(), "tubely-uploads")
+	}
+	err = os.MkdirAll(uploadsDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create upload staging directory: %v", err)
+	}
+
+	uploadExpiry, err := envDuration("UPLOAD_EXPIRY", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ffmpegLimits, err := ffmpegLimitsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	prober, transcoder, err := newMediaBackend(os.Getenv("MEDIA_BACKEND"), ffmpegLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
+	}
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		s3Client:					client,
-		port:             port,
+		db:              db,
+		jwtSecret:       jwtSecret,
+		platform:        platform,
+		filepathRoot:    filepathRoot,
+		assetsRoot:      assetsRoot,
+		port:            port,
+		jobMaxAttempts:  jobMaxAttempts,
+		jobWakeup:       make(chan struct{}, 1),
+		hlsLadder:       hlsLadder,
+		thumbnailOffset: thumbnailOffset,
+		mediaSigner:     newMediaSigner(jwtSecret, mediaURLExpiry),
+		mediaURLExpiry:  mediaURLExpiry,
+		uploadsDir:      uploadsDir,
+		uploadExpiry:    uploadExpiry,
+		deletionsWake:   make(chan struct{}, 1),
+		adminAPIKey:     os.Getenv("ADMIN_API_KEY"),
+		prober:          prober,
+		transcoder:      transcoder,
 	}
 
-	err = cfg.ensureAssetsDir()
+	err = cfg.setupStorage(storageBackend)
 	if err != nil {
-		log.Fatalf("Couldn't create assets directory: %v", err)
+		log.Fatal(err)
 	}
 
+	cfg.startWorkers(context.Background(), workerConcurrency)
+	go cfg.expireUploads(context.Background())
+	go cfg.runDeletions(context.Background())
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.Handle("/assets/", noCacheMiddleware(cfg.assetsHandler()))
+	if store, ok := cfg.videoStore.(*storage.MemoryStore); ok {
+		mux.Handle("/media/", noCacheMiddleware(cfg.memoryMediaHandler(store)))
+	}
+	mux.Handle("GET /playlists/{key...}", noCacheMiddleware(http.HandlerFunc(cfg.handlerPlaylist)))
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
@@ -125,17 +204,193 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerDirectUploadCreate)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerDirectUploadComplete)
+	mux.HandleFunc("OPTIONS /api/uploads", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/uploads", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/uploads/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/uploads/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/uploads/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_from_frame", cfg.handlerThumbnailFromFrame)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/search", cfg.handlerVideosSearch)
+	mux.HandleFunc("GET /api/videos/public", cfg.handlerVideosPublic)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerJobGet)
+
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/gc", cfg.handlerGC)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
 		Handler: mux,
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
+	log.Printf("Serving on: %s/app/\n", cfg.publicBaseURL)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// setupStorage creates the asset store and the video store for the
+// backend.
+func (cfg *apiConfig) setupStorage(backend string) error {
+	// PUBLIC_BASE_URL is where clients reach this server, e.g. behind a
+	// proxy. THUMBNAIL_BASE_URL optionally serves thumbnails publicly, e.g.
+	// from a CDN in front of the bucket.
+	cfg.publicBaseURL = strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if cfg.publicBaseURL == "" {
+		cfg.publicBaseURL = "http://localhost:" + cfg.port
+	}
+	cfg.thumbnailBaseURL = strings.TrimSuffix(os.Getenv("THUMBNAIL_BASE_URL"), "/")
+
+	assetsBaseURL := cfg.publicBaseURL + "/assets"
+	assetStore, err := storage.NewLocalStore(cfg.assetsRoot, assetsBaseURL)
+	if err != nil {
+		return fmt.Errorf("couldn't create assets directory: %w", err)
+	}
+	cfg.assetStore = assetStore
+
+	switch backend {
+	case "s3":
+		cfg.s3Bucket = os.Getenv("S3_BUCKET")
+		if cfg.s3Bucket == "" {
+			return errors.New("S3_BUCKET environment variable is not set")
+		}
+
+		cfg.s3Region = os.Getenv("S3_REGION")
+		if cfg.s3Region == "" {
+			return errors.New("S3_REGION environment variable is not set")
+		}
+
+		cfg.s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if cfg.s3CfDistribution == "" {
+			return errors.New("S3_CF_DISTRO environment variable is not set")
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(
+			context.TODO(),
+			config.WithRegion(cfg.s3Region),
+		)
+		if err != nil {
+			return fmt.Errorf("couldn't get aws config: %w", err)
+		}
+
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			// S3_ENDPOINT points at an S3 compatible server such as MinIO
+			// instead of AWS.
+			if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+				o.UsePathStyle = true
+			}
+		})
+		multipart, err := loadMultipartOptions()
+		if err != nil {
+			return err
+		}
+		cfg.videoStore = storage.NewS3Store(client, cfg.s3Bucket, "https://"+cfg.s3CfDistribution, multipart)
+
+		publicURL, err := url.Parse(cfg.publicBaseURL)
+		if err != nil {
+			return fmt.Errorf("invalid PUBLIC_BASE_URL: %w", err)
+		}
+		cfg.cloudFront, err = loadCloudFrontConfig(publicURL.Hostname(), cfg.s3CfDistribution)
+		if err != nil {
+			return err
+		}
+	case "local":
+		// Share the assets directory so the existing /assets/ file server
+		// can serve videos too.
+		cfg.videoStore = cfg.assetStore
+	case "memory":
+		// /assets/ is served from disk, so these get a route of their own.
+		cfg.videoStore = storage.NewMemoryStore(cfg.publicBaseURL + "/media")
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q, expected s3, local or memory", backend)
+	}
+	return nil
+}
+
+// loadMultipartOptions reads how large uploads to S3 are split up.
+func loadMultipartOptions() (storage.MultipartOptions, error) {
+	opts := storage.DefaultMultipartOptions
+	partSizeMB, err := envInt("S3_PART_SIZE_MB", int(opts.PartSize>>20))
+	if err != nil {
+		return opts, err
+	}
+	opts.PartSize = int64(partSizeMB) << 20
+	opts.Concurrency, err = envInt("S3_UPLOAD_CONCURRENCY", opts.Concurrency)
+	if err != nil {
+		return opts, err
+	}
+	opts.PartAttempts, err = envInt("S3_PART_ATTEMPTS", opts.PartAttempts)
+	if err != nil {
+		return opts, err
+	}
+	err = opts.Validate()
+	if err != nil {
+		return opts, fmt.Errorf("invalid S3 upload settings: %w", err)
+	}
+	return opts, nil
+}
+
+// envInt reads an optional integer environment variable.
+func envInt(name string, fallback int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", name, raw)
+	}
+	return n, nil
+}
+
+// ffmpegLimitsFromEnv reads the FFMPEG_* limits, falling back to
+// defaultFFmpegLimits.
+func ffmpegLimitsFromEnv() (ffmpegLimits, error) {
+	limits := defaultFFmpegLimits
+	var err error
+	limits.Concurrency, err = envInt("FFMPEG_CONCURRENCY", limits.Concurrency)
+	if err != nil {
+		return limits, err
+	}
+	limits.Threads, err = envInt("FFMPEG_THREADS", limits.Threads)
+	if err != nil {
+		return limits, err
+	}
+	if raw := os.Getenv("FFMPEG_NICE"); raw != "" {
+		limits.Nice, err = strconv.Atoi(raw)
+		if err != nil || limits.Nice < 0 || limits.Nice > 19 {
+			return limits, fmt.Errorf("FFMPEG_NICE must be between 0 and 19, got %q", raw)
+		}
+	}
+	limits.ProbeTimeout, err = envDuration("FFPROBE_TIMEOUT", limits.ProbeTimeout)
+	if err != nil {
+		return limits, err
+	}
+	limits.TranscodeTimeout, err = envDuration("FFMPEG_TIMEOUT", limits.TranscodeTimeout)
+	if err != nil {
+		return limits, err
+	}
+	limits.FrameTimeout, err = envDuration("FFMPEG_FRAME_TIMEOUT", limits.FrameTimeout)
+	if err != nil {
+		return limits, err
+	}
+	return limits, nil
+}
+
+// envDuration reads an optional duration such as "15m" from the environment.
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration like 15m, got %q", name, raw)
+	}
+	return d, nil
+}
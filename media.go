@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// mediaSigner mints and checks expiring links to the files served under
+// /assets/ and /media/. Object names are random so they can't be guessed,
+// and the signature means a link someone was handed stops working after a
+// while.
+type mediaSigner struct {
+	key    []byte
+	expiry time.Duration
+}
+
+func newMediaSigner(secret string, expiry time.Duration) mediaSigner {
+	return mediaSigner{key: []byte(secret), expiry: expiry}
+}
+
+var errInvalidMediaSignature = errors.New("invalid media signature")
+
+// sign returns the query string that grants access to every path starting
+// with scope until the link expires.
+func (s mediaSigner) sign(scope string, now time.Time) url.Values {
+	expires := strconv.FormatInt(now.Add(s.expiry).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("scope", scope)
+	query.Set("signature", s.mac(scope, expires))
+	return query
+}
+
+func (s mediaSigner) verify(urlPath string, query url.Values, now time.Time) error {
+	scope, expires, signature := query.Get("scope"), query.Get("expires"), query.Get("signature")
+	if scope == "" || signature == "" {
+		return errInvalidMediaSignature
+	}
+	// A scope ending in a slash covers a directory, like the segments of an
+	// HLS stream; anything else covers exactly one file.
+	if strings.HasSuffix(scope, "/") {
+		if !strings.HasPrefix(urlPath, scope) {
+			return errInvalidMediaSignature
+		}
+	} else if urlPath != scope {
+		return errInvalidMediaSignature
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errInvalidMediaSignature
+	}
+	if now.Unix() > expiresAt {
+		return errors.New("media link has expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.mac(scope, expires))) {
+		return errInvalidMediaSignature
+	}
+	return nil
+}
+
+func (s mediaSigner) mac(scope, expires string) string {
+	// The prefix keeps these from ever colliding with a JWT signed with the
+	// same secret.
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte("media\n" + scope + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// signURL adds a signature covering rawURL's file, or its whole directory
+// for HLS playlists, whose players fetch the rest of the stream relative to
+// them.
+func (cfg *apiConfig) signURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	scope := u.Path
+	if path.Ext(u.Path) == ".m3u8" {
+		scope = path.Dir(u.Path) + "/"
+	}
+	u.RawQuery = cfg.mediaSigner.sign(scope, time.Now()).Encode()
+	return u.String()
+}
+
+// signAssetURL signs URLs of files under /assets/ and returns any others as
+// they are.
+func (cfg *apiConfig) signAssetURL(rawURL *string) *string {
+	if rawURL == nil || !strings.HasPrefix(*rawURL, cfg.assetStore.URL("")) {
+		return rawURL
+	}
+	signed := cfg.signURL(*rawURL)
+	return &signed
+}
+
+// videoFileURL returns a link to a file of the video in the video store.
+func (cfg *apiConfig) videoFileURL(r *http.Request, video database.Video, key *string) *string {
+	if key == nil {
+		return nil
+	}
+	if cfg.cloudFront != nil {
+		return cfg.cloudFrontURL(r, video, *key)
+	}
+
+	// Stores that can't presign are served by this server, which checks
+	// a signature of its own.
+	presigner, ok := cfg.videoStore.(storage.Presigner)
+	if !ok {
+		fileURL := cfg.signURL(cfg.videoStore.URL(*key))
+		return &fileURL
+	}
+
+	// A presigned URL covers exactly one object, so playlists go through
+	// handlerPlaylist, which presigns every segment they list.
+	if path.Ext(*key) == ".m3u8" {
+		fileURL := cfg.signURL(cfg.playlistURL(*key))
+		return &fileURL
+	}
+	fileURL, err := presigner.PresignGet(r.Context(), *key, cfg.mediaURLExpiry)
+	if err != nil {
+		log.Printf("Couldn't presign %s: %v", *key, err)
+		return nil
+	}
+	return &fileURL
+}
+
+func (cfg *apiConfig) playlistURL(key string) string {
+	return cfg.publicBaseURL + "/playlists/" + key
+}
+
+// withMediaURLs prepares a video for a response by filling in links to its
+// media. Every handler that returns a video should pass it through here.
+func (cfg *apiConfig) withMediaURLs(r *http.Request, video database.Video) database.Video {
+	if video.ThumbnailKey != nil {
+		video.ThumbnailURL = cfg.thumbnailURL(r, video, *video.ThumbnailKey)
+	} else {
+		video.ThumbnailURL = cfg.signAssetURL(video.ThumbnailURL)
+	}
+	video.VideoURL = cfg.videoFileURL(r, video, video.VideoKey)
+	video.HLSURL = cfg.videoFileURL(r, video, video.HLSKey)
+	return video
+}
+
+// assetsHandler serves /assets/ to holders of a signed link.
+func (cfg *apiConfig) assetsHandler() http.Handler {
+	files := http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.assetsRoot)))
+	return cfg.signedFilesHandler("/assets/", cfg.assetStore, files)
+}
+
+// memoryMediaHandler serves /media/, where the memory backend's videos are
+// linked, to holders of a signed link.
+func (cfg *apiConfig) memoryMediaHandler(store *storage.MemoryStore) http.Handler {
+	return cfg.signedFilesHandler("/media/", store, http.StripPrefix("/media", store))
+}
+
+// signedFilesHandler checks the signature on requests for files under
+// prefix before handing them to files. Playlists are read from store
+// instead, so the signature can be passed on to what they list.
+func (cfg *apiConfig) signedFilesHandler(prefix string, store storage.BlobStore, files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := cfg.mediaSigner.verify(r.URL.Path, r.URL.Query(), time.Now())
+		if err != nil {
+			respondWithError(w, http.StatusForbidden, "Invalid or expired media link", err)
+			return
+		}
+		// Browsers must not second-guess the type of what users uploaded.
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if path.Ext(r.URL.Path) != ".m3u8" {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		// Players resolve the URIs in a playlist without our query string,
+		// so pass the signature on to them.
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		servePlaylist(w, r, store, key, func(uri string) (string, error) {
+			return uri + "?" + r.URL.RawQuery, nil
+		})
+	})
+}
+
+// handlerPlaylist serves HLS playlists whose segments need links of their
+// own: presigned S3 URLs, or CloudFront URLs signed for the playlist's
+// directory. Nested playlists come back through here.
+func (cfg *apiConfig) handlerPlaylist(w http.ResponseWriter, r *http.Request) {
+	err := cfg.mediaSigner.verify(r.URL.Path, r.URL.Query(), time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid or expired media link", err)
+		return
+	}
+
+	key := r.PathValue("key")
+	if path.Ext(key) != ".m3u8" {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	dir := path.Dir(key)
+
+	var segmentURL func(segmentKey string) (string, error)
+	if cfg.cloudFront != nil {
+		query, err := cfg.cloudFront.signer.SignedQuery(cfg.cloudFrontPolicy(r, cfg.videoStore.URL(dir)+"/*"))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+			return
+		}
+		segmentURL = func(segmentKey string) (string, error) {
+			return cfg.videoStore.URL(segmentKey) + "?" + query.Encode(), nil
+		}
+	} else if presigner, ok := cfg.videoStore.(storage.Presigner); ok {
+		segmentURL = func(segmentKey string) (string, error) {
+			return presigner.PresignGet(r.Context(), segmentKey, cfg.mediaURLExpiry)
+		}
+	} else {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	servePlaylist(w, r, cfg.videoStore, key, func(uri string) (string, error) {
+		if path.Ext(uri) == ".m3u8" {
+			return uri + "?" + r.URL.RawQuery, nil
+		}
+		return segmentURL(path.Join(dir, uri))
+	})
+}
+
+// servePlaylist writes out an HLS playlist with each relative URI in it
+// replaced by rewrite(uri).
+func servePlaylist(w http.ResponseWriter, r *http.Request, store storage.BlobStore, key string, rewrite func(uri string) (string, error)) {
+	playlist, err := store.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+	defer playlist.Close()
+
+	var out strings.Builder
+	scanner := bufio.NewScanner(playlist)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.Contains(line, "://") && !strings.HasPrefix(line, "/") {
+			line, err = rewrite(line)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+				return
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(out.String()))
+}
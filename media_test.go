@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage/s3fake"
+)
+
+// newS3UploadTest is newUploadTest with videos kept in a fake S3 bucket,
+// and the routes that hand out links to them.
+func newS3UploadTest(t *testing.T) (*uploadTest, *s3fake.Server) {
+	t.Helper()
+	ut := newUploadTest(t)
+	bucket := s3fake.New(t)
+	ut.cfg.videoStore = storage.NewS3Store(bucket.Client(), s3fake.Bucket, "https://media.example.com", storage.DefaultMultipartOptions)
+	ut.mux.HandleFunc("GET /api/videos", ut.cfg.handlerVideosRetrieve)
+	ut.mux.HandleFunc("GET /api/videos/{videoID}", ut.cfg.handlerVideoGet)
+	ut.mux.HandleFunc("GET /playlists/{key...}", ut.cfg.handlerPlaylist)
+	return ut, bucket
+}
+
+// get requests target from the mux as the video's owner.
+func (ut *uploadTest) get(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Authorization", "Bearer "+ut.token)
+	rec := httptest.NewRecorder()
+	ut.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// fetchMedia gets a link handed out for a file in the bucket.
+func fetchMedia(t *testing.T, rawURL string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", rawURL, err)
+	}
+	return resp.StatusCode, body
+}
+
+// playlistURIs returns the URIs an HLS playlist lists.
+func playlistURIs(playlist string) []string {
+	var uris []string
+	scanner := bufio.NewScanner(strings.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "#") {
+			uris = append(uris, line)
+		}
+	}
+	return uris
+}
+
+// checkPresigned makes sure videoURL is a working presigned link to key.
+func checkPresigned(t *testing.T, bucket *s3fake.Server, videoURL *string, key string) {
+	t.Helper()
+	if videoURL == nil || !strings.HasPrefix(*videoURL, bucket.URL+"/") {
+		t.Fatalf("got video URL %v, want one for the bucket", videoURL)
+	}
+	u, err := url.Parse(*videoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("X-Amz-Expires"); got != "3600" {
+		t.Errorf("got X-Amz-Expires %q, want the configured hour", got)
+	}
+
+	obj, _ := bucket.Object(key)
+	status, body := fetchMedia(t, *videoURL)
+	if status != http.StatusOK || !bytes.Equal(body, obj.Data) {
+		t.Errorf("got %d and %d bytes, want 200 and the %d byte video", status, len(body), len(obj.Data))
+	}
+}
+
+func TestVideoGetPresignsURLs(t *testing.T) {
+	ut, bucket := newS3UploadTest(t)
+	ut.uploadJob(t)
+	ut.runJobs(t)
+	stored := ut.video(t)
+	if stored.VideoKey == nil || stored.HLSKey == nil {
+		t.Fatal("processed video has no video or HLS key")
+	}
+	// Only keys are kept; links are made when the video is read.
+	if stored.VideoURL != nil {
+		t.Errorf("database has video URL %q", *stored.VideoURL)
+	}
+
+	rec := ut.get(t, "/api/videos/"+ut.videoID.String())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+	}
+	var video database.Video
+	err := json.NewDecoder(rec.Body).Decode(&video)
+	if err != nil {
+		t.Fatalf("decoding video: %v", err)
+	}
+	checkPresigned(t, bucket, video.VideoURL, *stored.VideoKey)
+
+	// The HLS link is a playlist whose segments are presigned one by one.
+	if video.HLSURL == nil || !strings.HasPrefix(*video.HLSURL, ut.cfg.publicBaseURL+"/playlists/") {
+		t.Fatalf("got HLS URL %v, want one served from /playlists/", video.HLSURL)
+	}
+	playlist := ut.get(t, strings.TrimPrefix(*video.HLSURL, ut.cfg.publicBaseURL))
+	if playlist.Code != http.StatusOK {
+		t.Fatalf("master playlist: got %d %s, want 200", playlist.Code, playlist.Body)
+	}
+	variants := playlistURIs(playlist.Body.String())
+	if len(variants) == 0 {
+		t.Fatalf("master playlist lists no renditions:\n%s", playlist.Body)
+	}
+	variant := variants[0]
+	rendition := ut.get(t, "/playlists/"+strings.TrimSuffix(*stored.HLSKey, "master.m3u8")+variant)
+	if rendition.Code != http.StatusOK {
+		t.Fatalf("rendition playlist %s: got %d %s, want 200", variant, rendition.Code, rendition.Body)
+	}
+	segments := playlistURIs(rendition.Body.String())
+	for _, segment := range segments {
+		if status, _ := fetchMedia(t, segment); status != http.StatusOK {
+			t.Errorf("segment %s: got %d, want 200", segment, status)
+		}
+	}
+	if len(segments) == 0 {
+		t.Errorf("rendition playlist lists no segments:\n%s", rendition.Body)
+	}
+}
+
+func TestVideosRetrievePresignsURLs(t *testing.T) {
+	ut, bucket := newS3UploadTest(t)
+	ut.uploadJob(t)
+	ut.runJobs(t)
+
+	rec := ut.get(t, "/api/videos")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+	}
+	var page struct {
+		Videos []database.Video `json:"videos"`
+	}
+	err := json.NewDecoder(rec.Body).Decode(&page)
+	if err != nil {
+		t.Fatalf("decoding videos: %v", err)
+	}
+	if len(page.Videos) != 1 {
+		t.Fatalf("got %d videos, want 1", len(page.Videos))
+	}
+	checkPresigned(t, bucket, page.Videos[0].VideoURL, *ut.video(t).VideoKey)
+}
+
+func TestPresignedURLsExpire(t *testing.T) {
+	ut, bucket := newS3UploadTest(t)
+	ut.cfg.mediaURLExpiry = time.Minute
+	ut.uploadJob(t)
+	ut.runJobs(t)
+
+	video := ut.cfg.withMediaURLs(httptest.NewRequest(http.MethodGet, "/", nil), ut.video(t))
+	if video.VideoURL == nil {
+		t.Fatal("video has no URL")
+	}
+	if status, _ := fetchMedia(t, *video.VideoURL); status != http.StatusOK {
+		t.Fatalf("got %d before the link expired, want 200", status)
+	}
+	bucket.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if status, _ := fetchMedia(t, *video.VideoURL); status != http.StatusForbidden {
+		t.Errorf("got %d after the link expired, want 403", status)
+	}
+}
+
+func TestVideoFileURL(t *testing.T) {
+	ut, bucket := newS3UploadTest(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	video := ut.video(t)
+	mp4, playlist := "landscape/boots.mp4", "landscape/boots/master.m3u8"
+
+	if got := ut.cfg.videoFileURL(r, video, nil); got != nil {
+		t.Errorf("got %q for no key, want nil", *got)
+	}
+
+	got := ut.cfg.videoFileURL(r, video, &mp4)
+	if got == nil || !strings.HasPrefix(*got, bucket.URL+"/"+s3fake.Bucket+"/"+mp4+"?") {
+		t.Errorf("got %v, want a presigned URL for %s", got, mp4)
+	}
+
+	got = ut.cfg.videoFileURL(r, video, &playlist)
+	if got == nil || !strings.HasPrefix(*got, ut.cfg.publicBaseURL+"/playlists/"+playlist+"?") {
+		t.Errorf("got %v, want the playlist served from /playlists/", got)
+	}
+
+	// Stores that can't presign are served from /assets/ with a signature
+	// of our own.
+	ut.cfg.videoStore = ut.store
+	got = ut.cfg.videoFileURL(r, video, &mp4)
+	if got == nil {
+		t.Fatal("got no URL from the memory store")
+	}
+	u, err := url.Parse(*got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/assets/"+mp4 {
+		t.Errorf("got path %q, want /assets/%s", u.Path, mp4)
+	}
+	if err := ut.cfg.mediaSigner.verify(u.Path, u.Query(), time.Now()); err != nil {
+		t.Errorf("asset URL doesn't verify: %v", err)
+	}
+}
+
+func TestMemoryMediaHandler(t *testing.T) {
+	ut := newUploadTest(t)
+	store := storage.NewMemoryStore(ut.cfg.publicBaseURL + "/media")
+	ut.cfg.videoStore = store
+	ut.mux.Handle("/media/", ut.cfg.memoryMediaHandler(store))
+	ut.uploadJob(t)
+	ut.runJobs(t)
+
+	stored := ut.video(t)
+	video := ut.cfg.withMediaURLs(httptest.NewRequest(http.MethodGet, "/", nil), stored)
+	if video.VideoURL == nil || !strings.HasPrefix(*video.VideoURL, ut.cfg.publicBaseURL+"/media/") {
+		t.Fatalf("got video URL %v, want one under /media/", video.VideoURL)
+	}
+	rec := ut.get(t, strings.TrimPrefix(*video.VideoURL, ut.cfg.publicBaseURL))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), sampleMP4) {
+		t.Errorf("got %d and %d bytes, want 200 and the video", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("got Content-Type %q, want video/mp4", got)
+	}
+	if rec := ut.get(t, "/media/"+*stored.VideoKey); rec.Code != http.StatusForbidden {
+		t.Errorf("got %d without a signature, want 403", rec.Code)
+	}
+
+	// Segments are fetched relative to the playlist, so it passes the
+	// signature on.
+	if video.HLSURL == nil {
+		t.Fatal("video has no HLS URL")
+	}
+	playlist := ut.get(t, strings.TrimPrefix(*video.HLSURL, ut.cfg.publicBaseURL))
+	if playlist.Code != http.StatusOK {
+		t.Fatalf("master playlist: got %d %s, want 200", playlist.Code, playlist.Body)
+	}
+	variants := playlistURIs(playlist.Body.String())
+	if len(variants) == 0 || !strings.Contains(variants[0], "signature=") {
+		t.Errorf("got renditions %v, want signed ones", variants)
+	}
+}
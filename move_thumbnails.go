@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Thumbnails used to be saved under ASSETS_ROOT on the server's own disk,
+// with links to localhost. move-thumbnails copies them into the video store
+// next to new ones, points their videos at the copies and removes the
+// originals.
+
+func runMoveThumbnailsCommand(pathToDB string, args []string) error {
+	flags := flag.NewFlagSet("move-thumbnails", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the thumbnails that would be moved without moving them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := commandConfig(pathToDB)
+	if err != nil {
+		return err
+	}
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return err
+	}
+
+	// Videos can share a thumbnail, so each file is moved once for all of
+	// them.
+	var keys []string
+	videosByKey := map[string][]database.Video{}
+	for _, video := range videos {
+		key, ok := cfg.legacyThumbnailKey(video)
+		if !ok {
+			continue
+		}
+		if _, seen := videosByKey[key]; !seen {
+			keys = append(keys, key)
+		}
+		videosByKey[key] = append(videosByKey[key], video)
+	}
+
+	ctx := context.Background()
+	var moved, failed int
+	for _, key := range keys {
+		newKey := thumbnailsPrefix + path.Base(key)
+		if *dryRun {
+			fmt.Printf("%s -> %s (%d videos)\n", key, newKey, len(videosByKey[key]))
+			continue
+		}
+		n, err := cfg.moveThumbnail(ctx, key, newKey, videosByKey[key])
+		moved += n
+		if err != nil {
+			fmt.Printf("Couldn't move %s: %v\n", key, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s -> %s\n", key, newKey)
+	}
+
+	if *dryRun {
+		fmt.Printf("\nWould move %d thumbnails\n", len(keys))
+		return nil
+	}
+	fmt.Printf("\nMoved %d thumbnails for %d videos\n", len(keys)-failed, moved)
+	if failed > 0 {
+		return fmt.Errorf("%d thumbnails couldn't be moved", failed)
+	}
+	return nil
+}
+
+// moveThumbnail copies the thumbnail at key in the asset store to newKey in
+// the video store, points the videos at the copy and removes the original.
+// It returns how many videos were moved.
+func (cfg *apiConfig) moveThumbnail(ctx context.Context, key, newKey string, videos []database.Video) (int, error) {
+	info, err := cfg.assetStore.Stat(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	src, err := cfg.assetStore.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	err = cfg.videoStore.Put(ctx, newKey, src, info.ContentType)
+	src.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for _, video := range videos {
+		// Videos whose thumbnail changed since we listed them no longer
+		// use the original either.
+		ok, err := cfg.db.MoveVideoThumbnail(video.ID, *video.ThumbnailURL, newKey)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	if moved == 0 {
+		err = cfg.videoStore.Delete(ctx, newKey)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return 0, err
+		}
+	}
+
+	err = cfg.assetStore.Delete(ctx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return moved, err
+	}
+	return moved, nil
+}
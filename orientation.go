@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A video's orientation is how its frame is shaped when it's played: after
+// rotation and with non-square pixels stretched out. It's stored on the
+// video for filtering and is the first part of its storage key.
+const (
+	orientationLandscape = "landscape" // about 16:9
+	orientationPortrait  = "portrait"  // about 9:16
+	orientationSquare    = "square"    // about 1:1
+	orientationUltrawide = "ultrawide" // 2:1 or wider, like 21:9
+	orientationOther     = "other"
+)
+
+var orientations = []string{
+	orientationLandscape,
+	orientationPortrait,
+	orientationSquare,
+	orientationUltrawide,
+	orientationOther,
+}
+
+const (
+	// orientationTolerance is how far a ratio may be from 16:9 or 9:16.
+	orientationTolerance = 0.1
+	// squareTolerance is narrower, so 5:4 and 4:5 aren't square.
+	squareTolerance = 0.05
+	// ultrawideRatio is the narrowest ratio that counts as ultra-wide.
+	ultrawideRatio = 2.0
+)
+
+var (
+	errNoVideoStream     = errors.New("no video stream")
+	errInvalidDimensions = errors.New("invalid video dimensions")
+)
+
+// getVideoAspectRatio classifies the primary video stream of a probed file
+// by its displayed aspect ratio.
+func getVideoAspectRatio(probe ffprobeOutput) (string, error) {
+	video, ok := probe.videoStream()
+	if !ok {
+		return "", errNoVideoStream
+	}
+	width, height, err := video.displaySize()
+	if err != nil {
+		return "", err
+	}
+	return orientationForRatio(width / height), nil
+}
+
+func orientationForRatio(ratio float64) string {
+	switch {
+	case math.Abs(ratio-16.0/9.0) <= orientationTolerance:
+		return orientationLandscape
+	case math.Abs(ratio-9.0/16.0) <= orientationTolerance:
+		return orientationPortrait
+	case math.Abs(ratio-1) <= squareTolerance:
+		return orientationSquare
+	case ratio >= ultrawideRatio:
+		return orientationUltrawide
+	}
+	return orientationOther
+}
+
+// displaySize returns the size a stream's frames are shown at: coded size
+// scaled by the sample aspect ratio, and swapped if it's rotated a quarter
+// turn.
+func (s ffprobeStream) displaySize() (float64, float64, error) {
+	if s.Width <= 0 || s.Height <= 0 {
+		return 0, 0, fmt.Errorf("%w: %dx%d", errInvalidDimensions, s.Width, s.Height)
+	}
+	width := float64(s.Width) * s.sampleAspectRatio()
+	height := float64(s.Height)
+	if rotation := s.rotation(); rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+// sampleAspectRatio returns how wide each pixel is relative to its height.
+// ffprobe reports "0:1" or leaves it out when it's unknown, which is taken
+// as square pixels.
+func (s ffprobeStream) sampleAspectRatio() float64 {
+	num, den, ok := strings.Cut(s.SampleAspectRatio, ":")
+	if !ok {
+		return 1
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 1
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d <= 0 {
+		return 1
+	}
+	return n / d
+}
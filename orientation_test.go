@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadProbe reads ffprobe output saved in testdata/ffprobe_<name>.json.
+func loadProbe(t *testing.T, name string) ffprobeOutput {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "ffprobe_"+name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var probe ffprobeOutput
+	err = json.Unmarshal(data, &probe)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return probe
+}
+
+func TestGetVideoAspectRatio(t *testing.T) {
+	tests := []struct {
+		probe   string
+		want    string
+		wantErr error
+	}{
+		{probe: "landscape_1080p", want: orientationLandscape},
+		{probe: "portrait_phone", want: orientationPortrait},
+		{probe: "audio_first", want: orientationLandscape},
+		// The square cover art comes first but isn't what's played.
+		{probe: "cover_art_first", want: orientationLandscape},
+		{probe: "audio_only", wantErr: errNoVideoStream},
+		{probe: "cover_art_only", wantErr: errNoVideoStream},
+		// Phones store portrait video as landscape frames and a rotation.
+		{probe: "rotate_tag", want: orientationPortrait},
+		{probe: "display_matrix", want: orientationPortrait},
+		{probe: "display_matrix_upside_down", want: orientationLandscape},
+		// The display matrix is what players follow when both are there.
+		{probe: "display_matrix_over_tag", want: orientationPortrait},
+		// 720x576 with wide pixels plays at 16:9; 720x480 with narrow
+		// ones at 4:3.
+		{probe: "anamorphic_pal_widescreen", want: orientationLandscape},
+		{probe: "anamorphic_ntsc_4x3", want: orientationOther},
+		{probe: "unknown_sar", want: orientationLandscape},
+		{probe: "square", want: orientationSquare},
+		{probe: "ultrawide", want: orientationUltrawide},
+		{probe: "four_by_three", want: orientationOther},
+		{probe: "zero_dimensions", wantErr: errInvalidDimensions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.probe, func(t *testing.T) {
+			got, err := getVideoAspectRatio(loadProbe(t, tt.probe))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrientationForRatio(t *testing.T) {
+	tests := []struct {
+		name  string
+		ratio float64
+		want  string
+	}{
+		{"16:9", 16.0 / 9.0, orientationLandscape},
+		{"16:10", 16.0 / 10.0, orientationOther},
+		{"1.85:1", 1.85, orientationLandscape},
+		{"9:16", 9.0 / 16.0, orientationPortrait},
+		{"1:1", 1, orientationSquare},
+		{"5:4", 5.0 / 4.0, orientationOther},
+		{"4:5", 4.0 / 5.0, orientationOther},
+		{"2:1", 2, orientationUltrawide},
+		{"21:9", 21.0 / 9.0, orientationUltrawide},
+		{"32:9", 32.0 / 9.0, orientationUltrawide},
+		{"1:2", 0.5, orientationPortrait},
+		{"1:3", 1.0 / 3.0, orientationOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orientationForRatio(tt.ratio); got != tt.want {
+				t.Errorf("orientationForRatio(%.3f) = %q, want %q", tt.ratio, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type ffprobeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+
+type ffprobeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	PixFmt    string `json:"pix_fmt"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	// SampleAspectRatio is the shape of a pixel, like "1:1" or "4:3".
+	SampleAspectRatio string            `json:"sample_aspect_ratio"`
+	AvgFrameRate      string            `json:"avg_frame_rate"`
+	RFrameRate        string            `json:"r_frame_rate"`
+	BitRate           string            `json:"bit_rate"`
+	Tags              map[string]string `json:"tags"`
+	SideDataList      []ffprobeSideData `json:"side_data_list"`
+	// Disposition flags the stream's role, like "default" or
+	// "attached_pic", with 1 for set and 0 for not.
+	Disposition map[string]int `json:"disposition"`
+}
+
+type ffprobeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  ffprobeFormat   `json:"format"`
+}
+
+// videoStream returns the primary video stream: the first one that isn't
+// an attached picture such as cover art, which ffprobe also lists as video.
+// It's the stream Normalize keeps.
+func (p ffprobeOutput) videoStream() (ffprobeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] == 0 {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+func (p ffprobeOutput) firstStream(codecType string) (ffprobeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+// mediaInfo converts ffprobe's output into what we store on the video.
+// Anything ffprobe didn't report is left nil.
+func (p ffprobeOutput) mediaInfo() database.MediaInfo {
+	info := database.MediaInfo{
+		Duration: parseFloat(p.Format.Duration),
+		BitRate:  parseInt(p.Format.BitRate),
+		FileSize: parseInt(p.Format.Size),
+	}
+
+	if video, ok := p.videoStream(); ok {
+		info.VideoCodec = nonEmpty(video.CodecName)
+		if video.Width > 0 && video.Height > 0 {
+			info.Width = &video.Width
+			info.Height = &video.Height
+		}
+		info.FrameRate = parseFrameRate(video.AvgFrameRate)
+		if info.FrameRate == nil {
+			info.FrameRate = parseFrameRate(video.RFrameRate)
+		}
+		rotation := video.rotation()
+		info.Rotation = &rotation
+		if info.BitRate == nil {
+			info.BitRate = parseInt(video.BitRate)
+		}
+	}
+
+	if audio, ok := p.firstStream("audio"); ok {
+		info.AudioCodec = nonEmpty(audio.CodecName)
+	}
+
+	return info
+}
+
+// rotation returns how far the player should rotate the frame, normalized to
+// 0, 90, 180 or 270 degrees clockwise. Newer ffmpeg versions report it in the
+// display matrix side data, older ones in the "rotate" tag.
+func (s ffprobeStream) rotation() int {
+	degrees := 0.0
+	found := false
+	for _, sideData := range s.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			// The display matrix rotation is counter-clockwise.
+			degrees = -sideData.Rotation
+			found = true
+			break
+		}
+	}
+	if !found {
+		if rotate, err := strconv.ParseFloat(s.Tags["rotate"], 64); err == nil {
+			degrees = rotate
+		}
+	}
+
+	normalized := int(math.Round(degrees/90)) * 90 % 360
+	if normalized < 0 {
+		normalized += 360
+	}
+	return normalized
+}
+
+func parseFrameRate(raw string) *float64 {
+	num, den, ok := strings.Cut(raw, "/")
+	if !ok {
+		return parseFloat(raw)
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return nil
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 || n == 0 {
+		return nil
+	}
+	rate := math.Round(n/d*1000) / 1000
+	return &rate
+}
+
+func parseFloat(raw string) *float64 {
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+func parseInt(raw string) *int64 {
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+)
+
+// Uploads are checked against what their bytes say they are, not just the
+// Content-Type the client sent, so a renamed executable can't be stored and
+// served back as an image or a video.
+
+// uploadError is an upload that was turned away because of its content.
+// Code tells clients why without them having to parse Message.
+type uploadError struct {
+	Code    string
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+const (
+	// uploadErrUnsupported means the file isn't any type we accept.
+	uploadErrUnsupported = "unsupported_content"
+	// uploadErrTypeMismatch means the file is a different type than it was
+	// uploaded as.
+	uploadErrTypeMismatch = "content_type_mismatch"
+	// uploadErrTruncated means the file ends before its format says it
+	// should.
+	uploadErrTruncated = "truncated_file"
+	// uploadErrTrailingData means there's more after the end of the file's
+	// format, like another file glued on to make a polyglot.
+	uploadErrTrailingData = "trailing_data"
+	// uploadErrCorrupt means the file is structured right but can't be
+	// decoded.
+	uploadErrCorrupt = "corrupt_file"
+	// uploadErrNoVideo means a video file has no video in it.
+	uploadErrNoVideo = "no_video_stream"
+)
+
+// respondWithUploadError explains an uploadError with 415 and its code.
+// Any other error is a 500.
+func respondWithUploadError(w http.ResponseWriter, msg string, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, uploadErr.Code, msg+": "+uploadErr.Message, err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, msg, err)
+}
+
+// videoSniffLen is how much of a video is needed to recognize its
+// container.
+const videoSniffLen = 12
+
+// sniffVideoContainer recognizes the container family of a video from its
+// first bytes, or returns "" if it isn't one we accept.
+func sniffVideoContainer(head []byte) string {
+	if len(head) < videoSniffLen {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return containerMatroska
+	case bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("AVI ")):
+		return containerAVI
+	}
+	// ISO base media files are a sequence of boxes, each a 4 byte size and
+	// a 4 byte type. Most start with ftyp; old QuickTime files don't.
+	switch string(head[4:8]) {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot":
+		return containerISOBMFF
+	}
+	return ""
+}
+
+// readVideoHeader reads as much of the start of a video as
+// sniffVideoContainer needs, or all of it if it's shorter.
+func readVideoHeader(r io.Reader) ([]byte, error) {
+	head := make([]byte, videoSniffLen)
+	n, err := io.ReadFull(r, head)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// checkVideoHeader checks the start of a video against the type it was
+// uploaded as. An empty mediaType accepts any container we support.
+func checkVideoHeader(head []byte, mediaType string) error {
+	if len(head) < videoSniffLen {
+		return &uploadError{Code: uploadErrTruncated, Message: "file is too short to be a video"}
+	}
+	container := sniffVideoContainer(head)
+	if container == "" {
+		return &uploadError{Code: uploadErrUnsupported, Message: "file isn't an MP4, MOV, WebM, MKV or AVI video"}
+	}
+	if inputType, ok := videoInputTypes[mediaType]; ok && inputType.container != container {
+		return &uploadError{Code: uploadErrTypeMismatch, Message: "file content doesn't match " + mediaType}
+	}
+	return nil
+}
+
+var (
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	jpegSignature = []byte{0xff, 0xd8, 0xff}
+)
+
+// checkImage makes sure data is a complete, decodable image of mediaType
+// with nothing after its end.
+func checkImage(data []byte, mediaType string) error {
+	var detected string
+	var end int
+	var err error
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		detected = "image/png"
+		end, err = pngEnd(data)
+	case bytes.HasPrefix(data, jpegSignature):
+		detected = "image/jpeg"
+		end, err = jpegEnd(data)
+	default:
+		return &uploadError{Code: uploadErrUnsupported, Message: "file isn't a PNG or JPEG image"}
+	}
+	if detected != mediaType {
+		return &uploadError{Code: uploadErrTypeMismatch, Message: "file content doesn't match " + mediaType}
+	}
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return &uploadError{Code: uploadErrTrailingData, Message: "file continues past the end of the image"}
+	}
+
+	_, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return &uploadError{Code: uploadErrCorrupt, Message: "couldn't decode image"}
+	}
+	return nil
+}
+
+var errImageTruncated = &uploadError{Code: uploadErrTruncated, Message: "image ends early"}
+
+// pngEnd walks the chunks of a PNG, checking their CRCs, and returns the
+// offset just past IEND.
+func pngEnd(data []byte) (int, error) {
+	pos := len(pngSignature)
+	for {
+		if len(data)-pos < 12 {
+			return 0, errImageTruncated
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || length > len(data)-pos-12 {
+			return 0, errImageTruncated
+		}
+		chunk := data[pos+4 : pos+8+length]
+		if crc32.ChecksumIEEE(chunk) != binary.BigEndian.Uint32(data[pos+8+length:]) {
+			return 0, &uploadError{Code: uploadErrCorrupt, Message: "PNG chunk checksum mismatch"}
+		}
+		pos += 12 + length
+		if string(chunk[:4]) == "IEND" {
+			return pos, nil
+		}
+	}
+}
+
+// jpegEnd walks the segments of a JPEG and returns the offset just past
+// its end of image marker.
+func jpegEnd(data []byte) (int, error) {
+	pos := 2 // SOI
+	for {
+		// Markers may be padded with any number of 0xff.
+		if pos >= len(data) || data[pos] != 0xff {
+			return 0, errImageTruncated
+		}
+		for pos < len(data) && data[pos] == 0xff {
+			pos++
+		}
+		if pos >= len(data) {
+			return 0, errImageTruncated
+		}
+		marker := data[pos]
+		pos++
+
+		switch {
+		case marker == 0xd9: // EOI
+			return pos, nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// Standalone markers have no length.
+			continue
+		}
+		if len(data)-pos < 2 {
+			return 0, errImageTruncated
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || length > len(data)-pos {
+			return 0, errImageTruncated
+		}
+		pos += length
+
+		if marker == 0xda { // SOS
+			// Entropy coded data follows, up to the next marker that
+			// isn't a stuffed 0xff00 or a restart marker.
+			for {
+				if len(data)-pos < 2 {
+					return 0, errImageTruncated
+				}
+				if data[pos] == 0xff {
+					next := data[pos+1]
+					if next != 0x00 && next != 0xff && (next < 0xd0 || next > 0xd7) {
+						break
+					}
+				}
+				pos++
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"testing/iotest"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 9))
+	for x := range 16 {
+		for y := range 9 {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 28), B: 0x80, A: 0xff})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngChunk builds a PNG chunk with a valid CRC.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// zipFile is the start of a ZIP archive's first local file header, which is
+// what a PNG/ZIP or JPEG/ZIP polyglot has after the image.
+var zipFile = []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00payload.jar")
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// uploadErrorCode returns the code of an uploadError, or "" for nil.
+func uploadErrorCode(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var uploadErr *uploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("got %v, want an uploadError", err)
+	}
+	return uploadErr.Code
+}
+
+func TestCheckImage(t *testing.T) {
+	pngData := encodePNG(t)
+	jpegData := encodeJPEG(t)
+	// The IHDR chunk follows the signature and is 25 bytes long.
+	ihdrEnd := len(pngSignature) + 25
+	iend := pngChunk("IEND", nil)
+
+	corruptCRC := bytes.Clone(pngData)
+	corruptCRC[ihdrEnd-1] ^= 0xff
+	// Every checksum is right, but the image data can't be inflated.
+	garbageIDAT := concat(pngData[:ihdrEnd], pngChunk("IDAT", []byte("not zlib at all")), iend)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		mediaType string
+		wantCode  string
+	}{
+		{name: "png", data: pngData, mediaType: "image/png"},
+		{name: "jpeg", data: jpegData, mediaType: "image/jpeg"},
+		// Ancillary chunks are part of the image.
+		{name: "png with a text chunk", data: concat(pngData[:ihdrEnd], pngChunk("tEXt", []byte("Comment\x00hi")), pngData[ihdrEnd:]), mediaType: "image/png"},
+
+		{name: "png sent as jpeg", data: pngData, mediaType: "image/jpeg", wantCode: uploadErrTypeMismatch},
+		{name: "jpeg sent as png", data: jpegData, mediaType: "image/png", wantCode: uploadErrTypeMismatch},
+		{name: "gif", data: []byte("GIF89a\x10\x00\x09\x00\x00\x00\x00;"), mediaType: "image/png", wantCode: uploadErrUnsupported},
+		{name: "html", data: []byte("<html><script>alert(1)</script></html>"), mediaType: "image/jpeg", wantCode: uploadErrUnsupported},
+		{name: "empty", data: nil, mediaType: "image/png", wantCode: uploadErrUnsupported},
+
+		{name: "png then zip", data: concat(pngData, zipFile), mediaType: "image/png", wantCode: uploadErrTrailingData},
+		{name: "jpeg then zip", data: concat(jpegData, zipFile), mediaType: "image/jpeg", wantCode: uploadErrTrailingData},
+		{name: "jpeg then html", data: concat(jpegData, []byte("<script>alert(1)</script>")), mediaType: "image/jpeg", wantCode: uploadErrTrailingData},
+		{name: "png then a second png", data: concat(pngData, pngData), mediaType: "image/png", wantCode: uploadErrTrailingData},
+		{name: "png with chunks after iend", data: concat(pngData, pngChunk("tEXt", []byte("hidden"))), mediaType: "image/png", wantCode: uploadErrTrailingData},
+
+		{name: "png signature only", data: pngSignature, mediaType: "image/png", wantCode: uploadErrTruncated},
+		{name: "png cut in a chunk", data: pngData[:ihdrEnd+10], mediaType: "image/png", wantCode: uploadErrTruncated},
+		{name: "png without iend", data: pngData[:len(pngData)-len(iend)], mediaType: "image/png", wantCode: uploadErrTruncated},
+		{name: "png chunk longer than the file", data: concat(pngData[:ihdrEnd], []byte("\x7f\xff\xff\xffIDAT")), mediaType: "image/png", wantCode: uploadErrTruncated},
+		{name: "jpeg signature only", data: jpegSignature, mediaType: "image/jpeg", wantCode: uploadErrTruncated},
+		{name: "jpeg cut in a segment", data: jpegData[:20], mediaType: "image/jpeg", wantCode: uploadErrTruncated},
+		{name: "jpeg without eoi", data: jpegData[:len(jpegData)-2], mediaType: "image/jpeg", wantCode: uploadErrTruncated},
+
+		{name: "png with a bad checksum", data: corruptCRC, mediaType: "image/png", wantCode: uploadErrCorrupt},
+		{name: "png that doesn't decode", data: garbageIDAT, mediaType: "image/png", wantCode: uploadErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkImage(tt.data, tt.mediaType)
+			if got := uploadErrorCode(t, err); got != tt.wantCode {
+				t.Errorf("got %v, want code %q", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestCheckVideoHeader(t *testing.T) {
+	var (
+		mp4       = []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00")
+		quicktime = []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00")
+		// Old QuickTime files start with a box other than ftyp.
+		oldQuickTime = []byte("\x00\x00\x02\x4cmoov\x00\x00\x00\x6c")
+		webm         = []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\xf7\x81")
+		avi          = []byte("RIFF\x24\x10\x00\x00AVI LIST")
+		wav          = []byte("RIFF\x24\x10\x00\x00WAVEfmt ")
+		elf          = []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00")
+		zip          = zipFile[:videoSniffLen]
+	)
+
+	tests := []struct {
+		name      string
+		head      []byte
+		mediaType string
+		wantCode  string
+	}{
+		{name: "mp4", head: mp4, mediaType: "video/mp4"},
+		{name: "quicktime", head: quicktime, mediaType: "video/quicktime"},
+		{name: "old quicktime", head: oldQuickTime, mediaType: "video/quicktime"},
+		// MP4 and MOV are the same container to ffmpeg.
+		{name: "mp4 sent as quicktime", head: mp4, mediaType: "video/quicktime"},
+		{name: "webm", head: webm, mediaType: "video/webm"},
+		{name: "webm sent as mkv", head: webm, mediaType: "video/x-matroska"},
+		{name: "avi", head: avi, mediaType: "video/x-msvideo"},
+		{name: "any type", head: avi, mediaType: ""},
+
+		{name: "webm sent as mp4", head: webm, mediaType: "video/mp4", wantCode: uploadErrTypeMismatch},
+		{name: "avi sent as webm", head: avi, mediaType: "video/webm", wantCode: uploadErrTypeMismatch},
+		{name: "mp4 sent as avi", head: mp4, mediaType: "video/x-msvideo", wantCode: uploadErrTypeMismatch},
+
+		{name: "wav", head: wav, mediaType: "video/x-msvideo", wantCode: uploadErrUnsupported},
+		{name: "elf", head: elf, mediaType: "video/mp4", wantCode: uploadErrUnsupported},
+		{name: "png signature", head: pngSignature, mediaType: "video/mp4", wantCode: uploadErrTruncated},
+		{name: "png header", head: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), mediaType: "video/mp4", wantCode: uploadErrUnsupported},
+		{name: "zip", head: zip, mediaType: "video/mp4", wantCode: uploadErrUnsupported},
+		{name: "any type, not a video", head: elf, mediaType: "", wantCode: uploadErrUnsupported},
+
+		{name: "empty", head: nil, mediaType: "video/mp4", wantCode: uploadErrTruncated},
+		{name: "one byte short", head: mp4[:videoSniffLen-1], mediaType: "video/mp4", wantCode: uploadErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkVideoHeader(tt.head, tt.mediaType)
+			if got := uploadErrorCode(t, err); got != tt.wantCode {
+				t.Errorf("got %v, want code %q", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReadVideoHeader(t *testing.T) {
+	mp4 := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00"), make([]byte, 100)...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantLen int
+	}{
+		{name: "long file", data: mp4, wantLen: videoSniffLen},
+		{name: "short file", data: mp4[:5], wantLen: 5},
+		{name: "empty file", data: nil, wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reading a byte at a time makes sure short reads are filled.
+			head, err := readVideoHeader(iotest.OneByteReader(bytes.NewReader(tt.data)))
+			if err != nil {
+				t.Fatalf("readVideoHeader: %v", err)
+			}
+			if len(head) != tt.wantLen || !bytes.Equal(head, tt.data[:tt.wantLen]) {
+				t.Errorf("got % x, want the first %d bytes", head, tt.wantLen)
+			}
+		})
+	}
+
+	_, err := readVideoHeader(iotest.ErrReader(errors.New("connection reset")))
+	if err == nil {
+		t.Error("got no error from a failing reader")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// parseThumbnailOffset reads THUMBNAIL_OFFSET. "auto" (the default) lets
+// ffmpeg pick the most representative frame near the start of the video,
+// anything else is a position in seconds.
+func parseThumbnailOffset(raw string) (*float64, error) {
+	if raw == "" || raw == "auto" {
+		return nil, nil
+	}
+	offset, err := strconv.ParseFloat(raw, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("THUMBNAIL_OFFSET must be \"auto\" or a number of seconds, got %q", raw)
+	}
+	return &offset, nil
+}
+
+// releaseThumbnail deletes the thumbnail a video had before it was
+// replaced, unless another video still uses it. The video is already saved
+// by then, so failures are only logged and left to gc.
+func (cfg *apiConfig) releaseThumbnail(previous database.Video) {
+	if previous.ThumbnailKey == nil && previous.ThumbnailURL == nil {
+		return
+	}
+	inUse, err := cfg.db.ThumbnailInUse(previous.ThumbnailKey, previous.ThumbnailURL)
+	if err != nil {
+		log.Printf("Couldn't check whether the old thumbnail of video %s is in use: %v", previous.ID, err)
+		return
+	}
+	if inUse {
+		return
+	}
+
+	var files []database.CreatePendingDeletionParams
+	if previous.ThumbnailKey != nil {
+		files = append(files, database.CreatePendingDeletionParams{Store: deletionStoreVideo, Key: *previous.ThumbnailKey})
+	}
+	if key, ok := cfg.legacyThumbnailKey(previous); ok {
+		files = append(files, database.CreatePendingDeletionParams{Store: deletionStoreAsset, Key: key})
+	}
+	if len(files) == 0 {
+		return
+	}
+	err = cfg.scheduleDeletions(files...)
+	if err != nil {
+		log.Printf("Couldn't schedule deletion of the old thumbnail of video %s: %v", previous.ID, err)
+	}
+}
+
+// respondWithThumbnail makes the thumbnail stored under key the video's,
+// releases exactly the one that it replaced, and responds with the video.
+func (cfg *apiConfig) respondWithThumbnail(w http.ResponseWriter, r *http.Request, videoID uuid.UUID, key string) {
+	previousKey, previousURL, err := cfg.db.SetVideoThumbnail(videoID, key)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		cfg.releaseThumbnail(database.Video{ID: videoID, ThumbnailKey: &key})
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.releaseThumbnail(database.Video{ID: videoID, ThumbnailKey: previousKey, ThumbnailURL: previousURL})
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cfg.withMediaURLs(r, video))
+}
+
+// thumbnailsPrefix is where thumbnails live in the video store.
+const thumbnailsPrefix = "thumbnails/"
+
+// saveThumbnail stores an image the same way uploaded thumbnails are stored
+// and returns its key in the video store.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, body io.Reader, mediaType string) (string, error) {
+	name, err := randomName()
+	if err != nil {
+		return "", err
+	}
+
+	key := thumbnailsPrefix + name + mediaTypeToExt(mediaType)
+	err = cfg.videoStore.Put(ctx, key, body, mediaType)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// thumbnailURL links to a thumbnail in the video store. With
+// THUMBNAIL_BASE_URL set, thumbnails are public and served from there;
+// otherwise they're protected like the video's own files.
+func (cfg *apiConfig) thumbnailURL(r *http.Request, video database.Video, key string) *string {
+	if cfg.thumbnailBaseURL != "" {
+		fileURL := cfg.thumbnailBaseURL + "/" + key
+		return &fileURL
+	}
+	if cfg.cloudFront != nil && cfg.cloudFront.delivery[video.Visibility] == cdnSignedCookie {
+		// The video's cookies only cover its own files.
+		signed, err := cfg.cloudFront.signer.SignURL(cfg.videoStore.URL(key), cfg.cloudFrontPolicy(r, ""))
+		if err != nil {
+			log.Printf("Couldn't sign CloudFront URL for %s: %v", key, err)
+			return nil
+		}
+		return &signed
+	}
+	return cfg.videoFileURL(r, video, &key)
+}
+
+// legacyThumbnailKey finds the file under ASSETS_ROOT that a thumbnail saved
+// before thumbnails moved to object storage points at. Those links were
+// made for localhost, so they're recognized on any port.
+func (cfg *apiConfig) legacyThumbnailKey(video database.Video) (string, bool) {
+	if video.ThumbnailURL == nil {
+		return "", false
+	}
+	if key, ok := strings.CutPrefix(*video.ThumbnailURL, cfg.assetStore.URL("")); ok {
+		return key, key != ""
+	}
+	u, err := url.Parse(*video.ThumbnailURL)
+	if err != nil || (u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1") {
+		return "", false
+	}
+	key, ok := strings.CutPrefix(u.Path, "/assets/")
+	return key, ok && key != ""
+}
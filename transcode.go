@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Uploads may come in any of a few common containers. Each one is
+// normalized to a faststart H.264/AAC MP4, which plays everywhere, copying
+// the streams that already are H.264 or AAC instead of re-encoding them.
+
+// Containers are grouped into families that file signatures and ffprobe
+// can't tell apart: MP4 and MOV are both ISO base media files, and WebM is
+// a restricted Matroska.
+const (
+	containerISOBMFF  = "isobmff"
+	containerMatroska = "matroska"
+	containerAVI      = "avi"
+)
+
+type videoInputType struct {
+	// ext is what the original is stored under.
+	ext       string
+	container string
+}
+
+// videoInputTypes are the media types uploads may have.
+var videoInputTypes = map[string]videoInputType{
+	"video/mp4":        {ext: ".mp4", container: containerISOBMFF},
+	"video/quicktime":  {ext: ".mov", container: containerISOBMFF},
+	"video/webm":       {ext: ".webm", container: containerMatroska},
+	"video/x-matroska": {ext: ".mkv", container: containerMatroska},
+	"video/x-msvideo":  {ext: ".avi", container: containerAVI},
+}
+
+// videoInputFormats maps the ffprobe format names of the allowed
+// containers to their family. ffprobe reports demuxers that handle
+// several, like "mov,mp4,m4a,3gp,3g2,mj2" or "matroska,webm".
+var videoInputFormats = map[string]string{
+	"mov":      containerISOBMFF,
+	"mp4":      containerISOBMFF,
+	"matroska": containerMatroska,
+	"webm":     containerMatroska,
+	"avi":      containerAVI,
+}
+
+// parseVideoType returns the media type in a client supplied Content-Type
+// if it's one uploads may have. The client is only trusted this far; the
+// file itself is checked by its signature and with ffprobe.
+func parseVideoType(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	_, ok := videoInputTypes[mediaType]
+	return mediaType, ok
+}
+
+// videoTypeForKey returns the media type an original was uploaded as, from
+// the extension newOriginalKey gave it.
+func videoTypeForKey(key string) (string, bool) {
+	ext := path.Ext(key)
+	for mediaType, inputType := range videoInputTypes {
+		if inputType.ext == ext {
+			return mediaType, true
+		}
+	}
+	return "", false
+}
+
+// checkVideoInput makes sure ffprobe found an allowed container with video
+// in it, and that it's what the upload claimed to be. An empty mediaType
+// accepts any allowed container.
+func checkVideoInput(probe ffprobeOutput, mediaType string) error {
+	container := ""
+	for _, format := range strings.Split(probe.Format.FormatName, ",") {
+		if family, ok := videoInputFormats[format]; ok {
+			container = family
+			break
+		}
+	}
+	if container == "" {
+		return &uploadError{Code: uploadErrUnsupported, Message: fmt.Sprintf("unsupported container %q", probe.Format.FormatName)}
+	}
+	if inputType, ok := videoInputTypes[mediaType]; ok && inputType.container != container {
+		return &uploadError{Code: uploadErrTypeMismatch, Message: fmt.Sprintf("uploaded as %s but ffprobe found %q", mediaType, probe.Format.FormatName)}
+	}
+	if _, ok := probe.videoStream(); !ok {
+		return &uploadError{Code: uploadErrNoVideo, Message: "no video stream found"}
+	}
+	return nil
+}
+
+// conformsToMP4 reports whether a video stream can be copied into the
+// published MP4 as is: H.264 in a pixel format every player decodes.
+func (s ffprobeStream) conformsToMP4() bool {
+	return s.CodecName == "h264" && (s.PixFmt == "yuv420p" || s.PixFmt == "yuvj420p")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tusRequest sends a tus request as the video's owner.
+func (ut *uploadTest) tusRequest(t *testing.T, method, target string, header http.Header, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Authorization", "Bearer "+ut.token)
+	rec := httptest.NewRecorder()
+	ut.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTusUploadProcessedFromParts(t *testing.T) {
+	ut := newUploadTest(t)
+	ut.mux.HandleFunc("POST /api/uploads", ut.cfg.handlerTusCreate)
+	ut.mux.HandleFunc("PATCH /api/uploads/{uploadID}", ut.cfg.handlerTusPatch)
+
+	rec := ut.tusRequest(t, http.MethodPost, "/api/uploads", http.Header{
+		"Upload-Length":   {strconv.Itoa(len(sampleMP4))},
+		"Upload-Metadata": {"video_id " + base64.StdEncoding.EncodeToString([]byte(ut.videoID.String()))},
+	}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s, want 201", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	// Two chunks, so the job has more than one part to read.
+	half := len(sampleMP4) / 2
+	var jobID string
+	for i, chunk := range [][]byte{sampleMP4[:half], sampleMP4[half:]} {
+		offset := i * half
+		rec := ut.tusRequest(t, http.MethodPatch, location, http.Header{
+			"Content-Type":  {"application/offset+octet-stream"},
+			"Upload-Offset": {strconv.Itoa(offset)},
+		}, chunk)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("patch at %d: got %d %s, want 204", offset, rec.Code, rec.Body)
+		}
+		jobID = rec.Header().Get("Tubely-Job-ID")
+	}
+
+	id, err := uuid.Parse(jobID)
+	if err != nil {
+		t.Fatalf("got job ID %q after the last chunk: %v", jobID, err)
+	}
+	var payload processVideoPayload
+	err = json.Unmarshal([]byte(ut.job(t, id).Payload), &payload)
+	if err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if len(payload.SourceParts) != 2 || payload.SourceKey != "" {
+		t.Errorf("got payload %+v, want the two parts as the source", payload)
+	}
+	// The final PATCH only queues the job; nothing is copied.
+	if originals := ut.keys(t, originalsPrefix(ut.videoID)); len(originals) != 0 {
+		t.Errorf("got originals %v, want the parts used as they are", originals)
+	}
+
+	ut.runJobs(t)
+	if job := ut.job(t, id); job.Status != database.JobStatusSucceeded {
+		t.Fatalf("job is %s (%v), want succeeded", job.Status, job.LastError)
+	}
+	if video := ut.video(t); video.VideoKey == nil {
+		t.Error("video wasn't published")
+	}
+	if parts := ut.keys(t, "uploads/"); len(parts) != 0 {
+		t.Errorf("parts %v are left after processing", parts)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestThumbnailFromFrameKeepsEdits(t *testing.T) {
+	ut := newUploadTest(t)
+	ut.mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_from_frame", ut.cfg.handlerThumbnailFromFrame)
+	ut.uploadJob(t)
+	ut.runJobs(t)
+	generated := ut.video(t).ThumbnailKey
+	if generated == nil {
+		t.Fatal("processed video has no thumbnail")
+	}
+
+	// The frame is taken after the handler reads the video, so an edit
+	// made then is one it could save over.
+	ut.media.extractFrame = func(io.Reader, *float64) ([]byte, error) {
+		video := ut.video(t)
+		video.Title = "Boots, edited"
+		video.Visibility = database.VisibilityPublic
+		err := ut.cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		return []byte("frame"), nil
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/videos/"+ut.videoID.String()+"/thumbnail_from_frame?t=2", nil)
+	req.Header.Set("Authorization", "Bearer "+ut.token)
+	rec := httptest.NewRecorder()
+	ut.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	video := ut.video(t)
+	if video.Title != "Boots, edited" || video.Visibility != database.VisibilityPublic {
+		t.Errorf("got %q (%s), want the edit kept", video.Title, video.Visibility)
+	}
+	if video.ThumbnailKey == nil || *video.ThumbnailKey == *generated {
+		t.Errorf("got thumbnail %v, want a new one", video.ThumbnailKey)
+	}
+
+	deletions, err := ut.cfg.db.ListPendingDeletions()
+	if err != nil {
+		t.Fatalf("ListPendingDeletions: %v", err)
+	}
+	if len(deletions) != 1 || deletions[0].Key != *generated {
+		t.Errorf("got pending deletions %+v, want only the replaced thumbnail %s", deletions, *generated)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// sampleMP4 starts like an MP4. fakeMedia takes it for a 1080p video.
+var sampleMP4 = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{0}, 1024)...)
+
+type uploadTest struct {
+	cfg     *apiConfig
+	media   *fakeMedia
+	store   *storage.MemoryStore
+	mux     *http.ServeMux
+	videoID uuid.UUID
+	token   string
+}
+
+func newUploadTest(t *testing.T) *uploadTest {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	media := newFakeMedia()
+	store := storage.NewMemoryStore("http://localhost:8091/assets")
+	cfg := &apiConfig{
+		db:             db,
+		jwtSecret:      testJWTSecret,
+		platform:       "dev",
+		port:           "8091",
+		publicBaseURL:  "http://localhost:8091",
+		videoStore:     store,
+		assetStore:     store,
+		jobMaxAttempts: 3,
+		jobWakeup:      make(chan struct{}, 1),
+		hlsLadder:      []hlsRendition{{Height: 720, BitrateKbps: 2800}},
+		mediaSigner:    newMediaSigner(testJWTSecret, time.Hour),
+		mediaURLExpiry: time.Hour,
+		uploadsDir:     t.TempDir(),
+		uploadExpiry:   time.Hour,
+		deletionsWake:  make(chan struct{}, 1),
+		prober:         media,
+		transcoder:     media,
+	}
+
+	user, err := db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := db.CreateVideo(database.CreateVideoParams{Title: "Boots", Description: "A video", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	return &uploadTest{cfg: cfg, media: media, store: store, mux: mux, videoID: video.ID, token: token}
+}
+
+// upload posts data as the video's file, sent as contentType.
+func (ut *uploadTest) upload(t *testing.T, contentType string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="boots"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+ut.videoID.String(), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+ut.token)
+	rec := httptest.NewRecorder()
+	ut.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// uploadJob uploads sampleMP4 and returns the job it was queued as.
+func (ut *uploadTest) uploadJob(t *testing.T) database.Job {
+	t.Helper()
+	rec := ut.upload(t, "video/mp4", sampleMP4)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("upload: got %d %s, want 202", rec.Code, rec.Body)
+	}
+	var job database.Job
+	err := json.NewDecoder(rec.Body).Decode(&job)
+	if err != nil {
+		t.Fatalf("decoding job: %v", err)
+	}
+	return job
+}
+
+// runJobs works through the jobs that are due, like a worker would.
+func (ut *uploadTest) runJobs(t *testing.T) {
+	t.Helper()
+	handlers := ut.cfg.jobHandlers()
+	for {
+		job, err := ut.cfg.db.ClaimJob(jobLease)
+		if err != nil {
+			t.Fatalf("ClaimJob: %v", err)
+		}
+		if job == nil {
+			return
+		}
+		ut.cfg.runJob(context.Background(), handlers, *job)
+	}
+}
+
+func (ut *uploadTest) job(t *testing.T, id uuid.UUID) database.Job {
+	t.Helper()
+	job, err := ut.cfg.db.GetJob(id)
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	return job
+}
+
+func (ut *uploadTest) video(t *testing.T) database.Video {
+	t.Helper()
+	video, err := ut.cfg.db.GetVideo(ut.videoID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	return video
+}
+
+func (ut *uploadTest) keys(t *testing.T, prefix string) []string {
+	t.Helper()
+	objects, err := ut.store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func TestUploadVideoQueuesJob(t *testing.T) {
+	ut := newUploadTest(t)
+
+	job := ut.uploadJob(t)
+	if job.Kind != jobKindProcessVideo || job.VideoID != ut.videoID || job.Status != database.JobStatusPending {
+		t.Errorf("got job %+v, want a pending %s job for video %s", job, jobKindProcessVideo, ut.videoID)
+	}
+
+	originals := ut.keys(t, originalsPrefix(ut.videoID))
+	if len(originals) != 1 || !strings.HasSuffix(originals[0], ".mp4") {
+		t.Fatalf("got originals %v, want one .mp4", originals)
+	}
+	if video := ut.video(t); video.VideoKey != nil {
+		t.Errorf("video has key %q before processing", *video.VideoKey)
+	}
+}
+
+func TestUploadVideoProcessed(t *testing.T) {
+	ut := newUploadTest(t)
+
+	job := ut.uploadJob(t)
+	ut.runJobs(t)
+
+	if job := ut.job(t, job.ID); job.Status != database.JobStatusSucceeded {
+		t.Fatalf("job is %s (%v), want succeeded", job.Status, job.LastError)
+	}
+	video := ut.video(t)
+	if video.VideoKey == nil || !strings.HasPrefix(*video.VideoKey, "landscape/") {
+		t.Errorf("got video key %v, want one under landscape/", video.VideoKey)
+	}
+	if video.Orientation == nil || *video.Orientation != "landscape" {
+		t.Errorf("got orientation %v, want landscape", video.Orientation)
+	}
+	if video.ThumbnailKey == nil {
+		t.Error("video has no thumbnail")
+	}
+	if video.HLSKey == nil {
+		t.Error("video has no HLS renditions")
+	}
+
+	if _, err := ut.store.Stat(context.Background(), *video.VideoKey); err != nil {
+		t.Errorf("published video: %v", err)
+	}
+	if originals := ut.keys(t, originalsPrefix(ut.videoID)); len(originals) != 0 {
+		t.Errorf("originals %v are left after processing", originals)
+	}
+}
+
+func TestUploadVideoKeepsEditsMadeWhileProcessing(t *testing.T) {
+	ut := newUploadTest(t)
+	job := ut.uploadJob(t)
+
+	// The thumbnail is taken after the job last reads the video, so an edit
+	// made then is one it could save over.
+	ut.media.extractFrame = func(io.Reader, *float64) ([]byte, error) {
+		video := ut.video(t)
+		video.Title = "Boots, edited"
+		video.Visibility = database.VisibilityPublic
+		uploaded := "thumbnails/uploaded.jpg"
+		video.ThumbnailKey = &uploaded
+		err := ut.cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		return []byte("frame"), nil
+	}
+	ut.runJobs(t)
+
+	if job := ut.job(t, job.ID); job.Status != database.JobStatusSucceeded {
+		t.Fatalf("job is %s (%v), want succeeded", job.Status, job.LastError)
+	}
+	video := ut.video(t)
+	if video.Title != "Boots, edited" || video.Visibility != database.VisibilityPublic {
+		t.Errorf("got %q (%s), want the edit kept", video.Title, video.Visibility)
+	}
+	if video.ThumbnailKey == nil || *video.ThumbnailKey != "thumbnails/uploaded.jpg" {
+		t.Errorf("got thumbnail %v, want the uploaded one kept", video.ThumbnailKey)
+	}
+	if video.VideoKey == nil || video.HLSKey == nil {
+		t.Errorf("got keys %v and %v, want the video published", video.VideoKey, video.HLSKey)
+	}
+
+	// The generated thumbnail went unused, so it's deleted.
+	deletions, err := ut.cfg.db.ListPendingDeletions()
+	if err != nil {
+		t.Fatalf("ListPendingDeletions: %v", err)
+	}
+	var thumbnails []string
+	for _, deletion := range deletions {
+		if strings.HasPrefix(deletion.Key, thumbnailsPrefix) {
+			thumbnails = append(thumbnails, deletion.Key)
+		}
+	}
+	if len(thumbnails) != 1 || thumbnails[0] == *video.ThumbnailKey {
+		t.Errorf("got thumbnails %v pending deletion, want the generated one", thumbnails)
+	}
+}
+
+func TestUploadVideoRejectsMismatchedContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		wantCode    string
+	}{
+		{
+			name:        "webm sent as mp4",
+			contentType: "video/mp4",
+			data:        []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\xf7\x81\x01"),
+			wantCode:    uploadErrTypeMismatch,
+		},
+		{
+			name:        "mp4 sent as avi",
+			contentType: "video/x-msvideo",
+			data:        sampleMP4,
+			wantCode:    uploadErrTypeMismatch,
+		},
+		{
+			name:        "png sent as mp4",
+			contentType: "video/mp4",
+			data:        []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"),
+			wantCode:    uploadErrUnsupported,
+		},
+		{
+			name:        "too short to tell",
+			contentType: "video/mp4",
+			data:        []byte("\x00\x00\x00\x18ftyp"),
+			wantCode:    uploadErrTruncated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut := newUploadTest(t)
+
+			rec := ut.upload(t, tt.contentType, tt.data)
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("got %d %s, want 415", rec.Code, rec.Body)
+			}
+			var resp struct {
+				Code string `json:"code"`
+			}
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Code != tt.wantCode {
+				t.Errorf("got code %q, want %q", resp.Code, tt.wantCode)
+			}
+			if keys := ut.keys(t, ""); len(keys) != 0 {
+				t.Errorf("rejected upload was stored as %v", keys)
+			}
+		})
+	}
+}
+
+func TestUploadVideoUnsupportedType(t *testing.T) {
+	ut := newUploadTest(t)
+
+	rec := ut.upload(t, "application/octet-stream", sampleMP4)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadVideoMediaFailures(t *testing.T) {
+	// What ffmpeg or ffprobe exiting with an error looks like.
+	exitError := func(program string) error {
+		return &ffmpegError{Program: program, Op: "test", ExitCode: 1, Err: errors.New("exit status 1")}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(media *fakeMedia)
+		// wantStatus is the processing job's status once the jobs that are
+		// due have run.
+		wantStatus    database.JobStatus
+		wantPublished bool
+		check         func(t *testing.T, ut *uploadTest, video database.Video)
+	}{
+		{
+			name: "probe rejects the file",
+			setup: func(media *fakeMedia) {
+				media.probe = func(string) (ffprobeOutput, error) { return ffprobeOutput{}, exitError("ffprobe") }
+			},
+			wantStatus: database.JobStatusFailed,
+		},
+		{
+			name: "probe can't run",
+			setup: func(media *fakeMedia) {
+				media.probe = func(string) (ffprobeOutput, error) { return ffprobeOutput{}, errors.New("ffprobe not found") }
+			},
+			// Retried later, since it may go better next time.
+			wantStatus: database.JobStatusPending,
+		},
+		{
+			name: "no video stream",
+			setup: func(media *fakeMedia) {
+				media.probe = func(string) (ffprobeOutput, error) {
+					return ffprobeOutput{
+						Streams: []ffprobeStream{{CodecType: "audio", CodecName: "aac"}},
+						Format:  ffprobeFormat{FormatName: fakeFormatNames[containerISOBMFF], Duration: "10.000000"},
+					}, nil
+				}
+			},
+			wantStatus: database.JobStatusFailed,
+		},
+		{
+			name: "normalize fails",
+			setup: func(media *fakeMedia) {
+				media.normalize = func(string, ffprobeOutput) (string, error) { return "", exitError("ffmpeg") }
+			},
+			wantStatus: database.JobStatusFailed,
+		},
+		{
+			name: "no frame for a thumbnail",
+			setup: func(media *fakeMedia) {
+				media.extractFrame = func(io.Reader, *float64) ([]byte, error) { return nil, exitError("ffmpeg") }
+			},
+			wantStatus:    database.JobStatusSucceeded,
+			wantPublished: true,
+			check: func(t *testing.T, ut *uploadTest, video database.Video) {
+				if video.ThumbnailKey != nil {
+					t.Errorf("got thumbnail %q, want none", *video.ThumbnailKey)
+				}
+			},
+		},
+		{
+			name: "HLS packaging fails",
+			setup: func(media *fakeMedia) {
+				media.transcodeHLS = func(string, string, hlsRendition) error { return errors.New("ffmpeg was killed") }
+			},
+			// The MP4 is published whatever happens to the renditions.
+			wantStatus:    database.JobStatusSucceeded,
+			wantPublished: true,
+			check: func(t *testing.T, ut *uploadTest, video database.Video) {
+				if video.HLSKey != nil {
+					t.Errorf("got HLS key %q, want none", *video.HLSKey)
+				}
+				jobs, err := ut.cfg.db.UnfinishedJobs(jobKindPackageHLS)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(jobs) != 1 || jobs[0].LastError == nil {
+					t.Errorf("got HLS jobs %+v, want one waiting to retry", jobs)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut := newUploadTest(t)
+			tt.setup(ut.media)
+
+			job := ut.uploadJob(t)
+			ut.runJobs(t)
+
+			job = ut.job(t, job.ID)
+			if job.Status != tt.wantStatus {
+				t.Fatalf("job is %s (%v), want %s", job.Status, job.LastError, tt.wantStatus)
+			}
+			if job.Status != database.JobStatusSucceeded && job.LastError == nil {
+				t.Error("job has no last_error")
+			}
+			video := ut.video(t)
+			if published := video.VideoKey != nil; published != tt.wantPublished {
+				t.Errorf("got video key %v, want published: %v", video.VideoKey, tt.wantPublished)
+			}
+			if tt.check != nil {
+				tt.check(t, ut, video)
+			}
+		})
+	}
+}
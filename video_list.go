@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	defaultVideosPageSize = 50
+	maxVideosPageSize     = 100
+)
+
+// videoListCursor is what clients get back as next_cursor. It remembers the
+// sort it was made for so it can't be replayed against a different one.
+type videoListCursor struct {
+	Sort       database.VideoSort `json:"s"`
+	Descending bool               `json:"d"`
+	database.VideoCursor
+}
+
+func encodeVideoListCursor(cursor videoListCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeVideoListCursor(raw string) (videoListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return videoListCursor{}, err
+	}
+	var cursor videoListCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return videoListCursor{}, err
+	}
+	return cursor, cursor.Sort.CheckCursor(cursor.VideoCursor)
+}
+
+// parseListVideosParams reads the paging, sorting and filtering options of
+// GET /api/videos. UserID is left for the caller to fill in.
+func parseListVideosParams(query url.Values) (database.ListVideosParams, error) {
+	params := database.ListVideosParams{
+		Limit:      defaultVideosPageSize,
+		Sort:       database.VideoSortCreated,
+		Descending: true,
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxVideosPageSize {
+			return params, fmt.Errorf("limit must be between 1 and %d", maxVideosPageSize)
+		}
+		params.Limit = limit
+	}
+
+	if raw := query.Get("sort"); raw != "" {
+		switch database.VideoSort(raw) {
+		case database.VideoSortCreated, database.VideoSortUpdated, database.VideoSortDuration:
+		case database.VideoSortTitle:
+			// Alphabetical is the only sort where oldest-first makes sense
+			// as the default.
+			params.Descending = false
+		default:
+			return params, errors.New("sort must be one of created, updated, title or duration")
+		}
+		params.Sort = database.VideoSort(raw)
+	}
+
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		params.Descending = false
+	case "desc":
+		params.Descending = true
+	default:
+		return params, errors.New("order must be asc or desc")
+	}
+
+	var err error
+	params.HasVideo, err = parseOptionalBool(query, "has_video")
+	if err != nil {
+		return params, err
+	}
+	params.HasThumbnail, err = parseOptionalBool(query, "has_thumbnail")
+	if err != nil {
+		return params, err
+	}
+
+	params.Orientation = query.Get("orientation")
+	if params.Orientation != "" && !slices.Contains(orientations, params.Orientation) {
+		return params, errors.New("orientation must be landscape, portrait, square, ultrawide or other")
+	}
+
+	params.Visibility = database.Visibility(query.Get("visibility"))
+	if params.Visibility != "" && !params.Visibility.Valid() {
+		return params, errors.New("visibility must be public, unlisted or private")
+	}
+
+	params.CreatedAfter, err = parseOptionalTime(query, "created_after")
+	if err != nil {
+		return params, err
+	}
+	params.CreatedBefore, err = parseOptionalTime(query, "created_before")
+	if err != nil {
+		return params, err
+	}
+
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeVideoListCursor(raw)
+		if err != nil {
+			return params, errors.New("invalid cursor")
+		}
+		if cursor.Sort != params.Sort || cursor.Descending != params.Descending {
+			return params, errors.New("cursor was created for a different sort order")
+		}
+		params.After = &cursor.VideoCursor
+	}
+
+	return params, nil
+}
+
+func parseOptionalBool(query url.Values, name string) (*bool, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+// parseOptionalTime accepts RFC 3339 timestamps or plain dates.
+func parseOptionalTime(query url.Values, name string) (*time.Time, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be a date (2006-01-02) or RFC 3339 timestamp", name)
+}
+
+// Search results are ranked, so they page by position rather than by key.
+func encodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeSearchCursor(raw string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(data))
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	return offset, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestVideosRetrieveRejectsMismatchedCursor(t *testing.T) {
+	ut := newUploadTest(t)
+	ut.mux.HandleFunc("GET /api/videos", ut.cfg.handlerVideosRetrieve)
+	id := uuid.NewString()
+
+	tests := []struct {
+		query  string
+		cursor string
+		want   int
+	}{
+		{query: "sort=created", cursor: `{"s":"created","d":true,"v":2460000.5,"id":"` + id + `"}`, want: http.StatusOK},
+		{query: "sort=created", cursor: `{"s":"created","d":true,"v":"1700000000.123456","id":"` + id + `"}`, want: http.StatusOK},
+		{query: "sort=title", cursor: `{"s":"title","d":false,"v":"Boots","id":"` + id + `"}`, want: http.StatusOK},
+		{query: "sort=created", cursor: `{"s":"created","d":true,"v":"Boots","id":"` + id + `"}`, want: http.StatusBadRequest},
+		{query: "sort=created", cursor: `{"s":"created","d":true,"v":{"a":1},"id":"` + id + `"}`, want: http.StatusBadRequest},
+		{query: "sort=duration", cursor: `{"s":"duration","d":true,"v":null,"id":"` + id + `"}`, want: http.StatusBadRequest},
+		{query: "sort=title", cursor: `{"s":"title","d":false,"v":12,"id":"` + id + `"}`, want: http.StatusBadRequest},
+		{query: "sort=title", cursor: `{"s":"title","d":false,"v":"Boots"}`, want: http.StatusBadRequest},
+		{query: "sort=title", cursor: `{"s":"title","d":false,"v":"Boots","id":"not-a-uuid"}`, want: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(tc.cursor))
+		rec := ut.get(t, "/api/videos?"+tc.query+"&cursor="+cursor)
+		if rec.Code != tc.want {
+			t.Errorf("cursor %s: got %d %s, want %d", tc.cursor, rec.Code, rec.Body, tc.want)
+		}
+	}
+}
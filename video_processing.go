@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const jobKindProcessVideo = "process_video"
+
+type processVideoPayload struct {
+	SourceKey string `json:"source_key,omitempty"`
+	// SourceParts are the parts of a resumable upload, in order. They're
+	// read one after another in place of a single SourceKey, so finishing
+	// an upload doesn't mean copying it.
+	SourceParts []string `json:"source_parts,omitempty"`
+	// SourceType is the type a resumable upload was created with, if any.
+	// Single files carry theirs in the key's extension.
+	SourceType string `json:"source_type,omitempty"`
+}
+
+func (cfg *apiConfig) enqueueVideoProcessing(videoID uuid.UUID, sourceKey string) (database.Job, error) {
+	return cfg.enqueueProcessVideo(videoID, processVideoPayload{SourceKey: sourceKey})
+}
+
+// enqueueUploadProcessing queues processing of a resumable upload straight
+// from its parts, which the job deletes once it's done with them.
+func (cfg *apiConfig) enqueueUploadProcessing(videoID uuid.UUID, partKeys []string, mediaType string) (database.Job, error) {
+	return cfg.enqueueProcessVideo(videoID, processVideoPayload{SourceParts: partKeys, SourceType: mediaType})
+}
+
+func (cfg *apiConfig) enqueueProcessVideo(videoID uuid.UUID, payload processVideoPayload) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	return cfg.enqueueJob(database.CreateJobParams{
+		Kind:    jobKindProcessVideo,
+		VideoID: videoID,
+		Payload: string(data),
+	})
+}
+
+// sourceKeys lists the stored files the job processes.
+func (p processVideoPayload) sourceKeys() []string {
+	if len(p.SourceParts) > 0 {
+		return p.SourceParts
+	}
+	return []string{p.SourceKey}
+}
+
+// sourceType is the type the upload claimed to be, or "" if it didn't say.
+func (p processVideoPayload) sourceType() string {
+	if len(p.SourceParts) > 0 {
+		return p.SourceType
+	}
+	mediaType, _ := videoTypeForKey(p.SourceKey)
+	return mediaType
+}
+
+// openSource reads the upload the job processes.
+func (cfg *apiConfig) openSource(ctx context.Context, payload processVideoPayload) (io.ReadCloser, error) {
+	if len(payload.SourceParts) > 0 {
+		return &stagedUploadReader{ctx: ctx, store: cfg.videoStore, keys: slices.Clone(payload.SourceParts)}, nil
+	}
+	return cfg.videoStore.Get(ctx, payload.SourceKey)
+}
+
+// deleteSource deletes the upload the job processed.
+func (cfg *apiConfig) deleteSource(ctx context.Context, payload processVideoPayload) error {
+	var errs []error
+	for _, key := range payload.sourceKeys() {
+		err := cfg.videoStore.Delete(ctx, key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// processVideoJob turns an uploaded original into the published faststart
+// H.264/AAC MP4 and points the video at it. Uploads are identified by their SHA-256,
+// so a file that was already processed for any video is published as the
+// same blob instead of being processed and stored again.
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return permanent(err)
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while the job was queued.
+		return cfg.deleteSource(ctx, payload)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // Delete file when done
+	defer tempFile.Close()           // Close file when done (runs BEFORE remove)
+
+	original, err := cfg.openSource(ctx, payload)
+	if errors.Is(err, storage.ErrNotFound) {
+		return permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tempFile, hasher), original)
+	original.Close()
+	if errors.Is(err, storage.ErrNotFound) {
+		// A part of a resumable upload is only opened once it's reached.
+		return permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	blob, err := cfg.db.GetBlob(hash)
+	if err != nil {
+		return err
+	}
+	if blob.Key != "" {
+		err = cfg.reuseVideoBlob(ctx, video.ID, blob)
+		if err != nil && !errors.Is(err, database.ErrVideoNotFound) {
+			// If the blob went away since we looked, the retry processes
+			// the file from scratch.
+			return err
+		}
+		return cfg.deleteSource(ctx, payload)
+	}
+
+	// What the file really is comes from ffprobe, not the client.
+	input, err := cfg.prober.Probe(ctx, tempFile.Name())
+	if err != nil {
+		return mediaJobError(fmt.Errorf("couldn't probe upload: %w", err))
+	}
+	err = checkVideoInput(input, payload.sourceType())
+	if err != nil {
+		return mediaJobError(err)
+	}
+
+	processedOutputPath, err := cfg.transcoder.Normalize(ctx, tempFile.Name(), input)
+	if err != nil {
+		return mediaJobError(fmt.Errorf("couldn't normalize video: %w", err))
+	}
+	defer os.Remove(processedOutputPath)
+
+	probe, err := cfg.prober.Probe(ctx, processedOutputPath)
+	if err != nil {
+		return mediaJobError(fmt.Errorf("couldn't probe processed video: %w", err))
+	}
+
+	aspectRatio, err := getVideoAspectRatio(probe)
+	if err != nil {
+		return mediaJobError(fmt.Errorf("couldn't get aspect ratio: %w", err))
+	}
+
+	// The random part keeps a blob that's made again after its last
+	// reference went away clear of the pending deletion of the old one.
+	name, err := randomName()
+	if err != nil {
+		return err
+	}
+	fileKey := fmt.Sprintf("%s/%s-%s.mp4", aspectRatio, hash, name[:8])
+
+	processedFile, err := os.Open(processedOutputPath)
+	if err != nil {
+		return err
+	}
+	defer processedFile.Close()
+
+	err = cfg.videoStore.Put(ctx, fileKey, processedFile, "video/mp4")
+	if err != nil {
+		return err
+	}
+
+	// Re-read the video to see whether it was deleted or given a thumbnail
+	// while we worked.
+	video, err = cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		cfg.videoStore.Delete(ctx, fileKey)
+		return cfg.deleteSource(ctx, payload)
+	}
+
+	needsThumbnail := video.ThumbnailKey == nil && video.ThumbnailURL == nil
+	if needsThumbnail {
+		cfg.addThumbnail(ctx, &video, func() (io.ReadCloser, error) {
+			return os.Open(processedOutputPath)
+		})
+	}
+
+	video.VideoKey = &fileKey
+	video.MediaInfo = probe.mediaInfo()
+	video.Orientation = &aspectRatio
+	// Renditions of the previous upload no longer match the video.
+	video.HLSKey = nil
+	err = cfg.db.CreateVideoBlob(video, hash, blobFiles)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		cfg.videoStore.Delete(ctx, fileKey)
+		return cfg.deleteSource(ctx, payload)
+	}
+	if errors.Is(err, database.ErrBlobExists) {
+		// Someone uploaded the same file at the same time; the retry
+		// reuses their blob.
+		cfg.videoStore.Delete(ctx, fileKey)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if needsThumbnail {
+		cfg.releaseUnusedThumbnail(video)
+	}
+
+	if len(cfg.hlsLadder) > 0 {
+		_, err = cfg.enqueueHLSPackaging(video.ID, fileKey)
+		if err != nil {
+			// The MP4 is already published; don't redo it just for HLS.
+			log.Printf("Couldn't queue HLS packaging for video %s: %v", video.ID, err)
+		}
+	}
+
+	return cfg.deleteSource(ctx, payload)
+}
+
+// reuseVideoBlob publishes the video as a blob that was already made from
+// the same upload, taking its media details from a video that uses it.
+func (cfg *apiConfig) reuseVideoBlob(ctx context.Context, videoID uuid.UUID, blob database.Blob) error {
+	sibling, err := cfg.db.GetVideoByKey(blob.Key)
+	if err != nil {
+		return err
+	}
+	if sibling.ID == uuid.Nil {
+		return database.ErrBlobNotFound
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return database.ErrVideoNotFound
+	}
+	if video.VideoKey != nil && *video.VideoKey == blob.Key {
+		// Already published as this blob; the same file was re-uploaded.
+		return nil
+	}
+
+	needsThumbnail := video.ThumbnailKey == nil && video.ThumbnailURL == nil
+	if needsThumbnail {
+		// The upload may be in any container, but the blob is a faststart
+		// MP4 that ffmpeg can read as it streams in.
+		cfg.addThumbnail(ctx, &video, func() (io.ReadCloser, error) {
+			return cfg.videoStore.Get(ctx, blob.Key)
+		})
+	}
+
+	video.VideoKey = &blob.Key
+	video.MediaInfo = sibling.MediaInfo
+	video.Orientation = sibling.Orientation
+	// Renditions are shared too, and SetHLSKey fills this in for every
+	// video once they're packaged.
+	video.HLSKey = sibling.HLSKey
+	err = cfg.db.ReuseVideoBlob(video, blob.Hash, blobFiles)
+	if err != nil {
+		return err
+	}
+	if needsThumbnail {
+		cfg.releaseUnusedThumbnail(video)
+	}
+	return nil
+}
+
+// releaseUnusedThumbnail deletes the thumbnail generated for a video if it
+// was given one of its own while it was processed, which the database kept
+// instead.
+func (cfg *apiConfig) releaseUnusedThumbnail(video database.Video) {
+	if video.ThumbnailKey == nil {
+		return
+	}
+	cfg.releaseThumbnail(database.Video{ID: video.ID, ThumbnailKey: video.ThumbnailKey})
+}
+
+// addThumbnail gives the video a thumbnail taken from the published MP4
+// that open reads. A missing thumbnail shouldn't hold back the video
+// itself, so failures are only logged.
+func (cfg *apiConfig) addThumbnail(ctx context.Context, video *database.Video, open func() (io.ReadCloser, error)) {
+	key, err := cfg.generateThumbnail(ctx, open)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		return
+	}
+	video.ThumbnailKey = &key
+}
+
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, open func() (io.ReadCloser, error)) (string, error) {
+	videoFile, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer videoFile.Close()
+
+	frame, err := cfg.transcoder.ExtractFrame(ctx, videoFile, cfg.thumbnailOffset)
+	if err != nil {
+		return "", err
+	}
+	return cfg.saveThumbnail(ctx, bytes.NewReader(frame), "image/jpeg")
+}
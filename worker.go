@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	jobLease        = 2 * time.Minute
+	jobPollInterval = 2 * time.Second
+	jobRetryBase    = 10 * time.Second
+	jobRetryMax     = 30 * time.Minute
+)
+
+type jobHandler func(ctx context.Context, job database.Job) error
+
+// permanentError marks a job failure that retrying won't fix, like a file
+// ffprobe can't read.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// mediaJobError makes failures that are down to the file itself permanent:
+// uploads that fail our checks, and files ffmpeg ran on to the end and gave
+// up on. ffmpeg not starting, timing out or being killed may go better next
+// time, so those are retried like any other error.
+func mediaJobError(err error) error {
+	var uploadErr *uploadError
+	var ffErr *ffmpegError
+	switch {
+	case errors.As(err, &uploadErr),
+		errors.As(err, &ffErr) && ffErr.ExitCode > 0,
+		errors.Is(err, errNoVideoStream),
+		errors.Is(err, errInvalidDimensions):
+		return permanent(err)
+	}
+	return err
+}
+
+func (cfg *apiConfig) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobKindProcessVideo: cfg.processVideoJob,
+		jobKindPackageHLS:   cfg.packageHLSJob,
+	}
+}
+
+func (cfg *apiConfig) enqueueJob(params database.CreateJobParams) (database.Job, error) {
+	if params.MaxAttempts == 0 {
+		params.MaxAttempts = cfg.jobMaxAttempts
+	}
+	job, err := cfg.db.CreateJob(params)
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	// Wake an idle worker instead of waiting for the next poll.
+	select {
+	case cfg.jobWakeup <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (cfg *apiConfig) startWorkers(ctx context.Context, n int) {
+	handlers := cfg.jobHandlers()
+	for i := 0; i < n; i++ {
+		go cfg.runWorker(ctx, handlers)
+	}
+}
+
+func (cfg *apiConfig) runWorker(ctx context.Context, handlers map[string]jobHandler) {
+	for {
+		job, err := cfg.db.ClaimJob(jobLease)
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if job != nil {
+			cfg.runJob(ctx, handlers, *job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.jobWakeup:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, handlers map[string]jobHandler, job database.Job) {
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		cfg.finishJob(job, permanent(fmt.Errorf("unknown job kind %q", job.Kind)))
+		return
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go cfg.heartbeatJob(jobCtx, job)
+
+	cfg.finishJob(job, callJobHandler(jobCtx, handler, job))
+}
+
+func callJobHandler(ctx context.Context, handler jobHandler, job database.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func (cfg *apiConfig) heartbeatJob(ctx context.Context, job database.Job) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := cfg.db.ExtendJobLease(job.ID, job.Attempts, jobLease)
+			if err != nil {
+				log.Printf("Couldn't extend lease for job %s: %v", job.ID, err)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) finishJob(job database.Job, jobErr error) {
+	var err error
+	switch {
+	case jobErr == nil:
+		err = cfg.db.CompleteJob(job.ID, job.Attempts)
+	case errors.As(jobErr, &permanentError{}) || job.Attempts >= job.MaxAttempts:
+		log.Printf("Job %s (%s) failed after %d attempts: %v", job.ID, job.Kind, job.Attempts, jobErr)
+		err = cfg.db.FailJob(job.ID, job.Attempts, jobErr.Error())
+	default:
+		runAt := time.Now().Add(jobBackoff(job.Attempts))
+		log.Printf("Job %s (%s) failed, retrying at %s: %v", job.ID, job.Kind, runAt.Format(time.RFC3339), jobErr)
+		err = cfg.db.RetryJob(job.ID, job.Attempts, runAt, jobErr.Error())
+	}
+	if err != nil {
+		log.Printf("Couldn't record result of job %s: %v", job.ID, err)
+	}
+}
+
+// jobBackoff doubles the delay for every failed attempt.
+func jobBackoff(attempts int) time.Duration {
+	delay := jobRetryBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= jobRetryMax {
+			return jobRetryMax
+		}
+	}
+	return delay
+}